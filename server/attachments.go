@@ -0,0 +1,215 @@
+package mig
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/guregu/null"
+	"github.com/rs/zerolog/log"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	errAttachmentTooLarge    = errors.New("attachment is too large")
+	errQuotaExceeded         = errors.New("attachments quota exceeded")
+	errInvalidSignature      = errors.New("invalid or expired download signature")
+	errInvalidAttachments    = errors.New("attachment_ids must reference unsent attachments uploaded by the sender")
+	errMissingAttachmentName = errors.New("missing attachment filename")
+	errInvalidImage          = errors.New("invalid image")
+	errImageTooLarge         = errors.New("image dimensions are too large")
+)
+
+// AttachmentService stores uploaded files in the blob storage and signs their download URLs.
+type AttachmentService struct {
+	repo    AttachmentsRepository
+	storage BlobStorage
+	secret  []byte        // key of download URL signatures
+	urlTTL  time.Duration // validity of signed download URLs
+	maxSize int64         // bytes allowed per attachment
+	quota   int64         // bytes allowed per user across attachments
+}
+
+func NewAttachmentService(repo AttachmentsRepository, storage BlobStorage, secret string, urlTTL time.Duration, maxSize, quota int64) *AttachmentService {
+	return &AttachmentService{
+		repo:    repo,
+		storage: storage,
+		secret:  []byte(secret),
+		urlTTL:  urlTTL,
+		maxSize: maxSize,
+		quota:   quota,
+	}
+}
+
+func (s *AttachmentService) upload(ctx context.Context, user User, filename string, file io.ReadSeeker, size int64) (Attachment, error) {
+	filename = filepath.Base(filename)
+	if filename == "" || filename == "." || filename == string(filepath.Separator) {
+		return Attachment{}, errMissingAttachmentName
+	}
+
+	if size > s.maxSize {
+		return Attachment{}, errAttachmentTooLarge
+	}
+
+	used, err := s.repo.getUploadedSize(ctx, user.ID)
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	if used+size > s.quota {
+		return Attachment{}, errQuotaExceeded
+	}
+
+	attachment := Attachment{
+		UploaderID: user.ID,
+		StorageKey: fmt.Sprintf("attachments/%d/%s", user.ID, uuid.NewString()),
+		Filename:   filename,
+		Size:       size,
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return Attachment{}, err
+	}
+	attachment.MimeType = http.DetectContentType(head[:n])
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return Attachment{}, err
+	}
+
+	// location metadata must never reach the storage
+	if strings.HasPrefix(attachment.MimeType, "image/") {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return Attachment{}, err
+		}
+
+		data, err = stripMetadata(data, attachment.MimeType)
+		if err != nil {
+			return Attachment{}, err
+		}
+		file = bytes.NewReader(data)
+		size = int64(len(data))
+		attachment.Size = size
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return Attachment{}, err
+	}
+	attachment.Checksum = hex.EncodeToString(hash.Sum(nil))
+
+	if strings.HasPrefix(attachment.MimeType, "image/") {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return Attachment{}, err
+		}
+
+		if config, _, err := image.DecodeConfig(file); err == nil {
+			if int64(config.Width)*int64(config.Height) > maxImagePixels {
+				return Attachment{}, errImageTooLarge
+			}
+
+			attachment.Width = null.IntFrom(int64(config.Width))
+			attachment.Height = null.IntFrom(int64(config.Height))
+		}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return Attachment{}, err
+	}
+
+	if err := s.storage.put(ctx, attachment.StorageKey, file, size, attachment.MimeType); err != nil {
+		return Attachment{}, err
+	}
+
+	created, err := s.repo.createAttachment(ctx, attachment)
+	if err != nil {
+		if err := s.storage.delete(ctx, attachment.StorageKey); err != nil {
+			log.Error().Msg(err.Error())
+		}
+		return Attachment{}, err
+	}
+
+	return s.withURL(created), nil
+}
+
+// sets download URLs of the attachment and its thumbnails valid for urlTTL
+func (s *AttachmentService) withURL(a Attachment) Attachment {
+	expires := time.Now().Add(s.urlTTL).Unix()
+
+	a.URL = fmt.Sprintf("/v1/attachments/%d/download?expires=%d&signature=%s", a.ID, expires, s.signature(a.ID, 0, expires))
+
+	thumbnails := []Thumbnail{}
+	for _, t := range a.Thumbnails {
+		t.URL = fmt.Sprintf("/v1/attachments/%d/thumbnails/%d/download?expires=%d&signature=%s", a.ID, t.Width, expires, s.signature(a.ID, t.Width, expires))
+		t.StorageKey = ""
+		thumbnails = append(thumbnails, t)
+	}
+	a.Thumbnails = thumbnails
+
+	return a
+}
+
+// width is 0 for the original attachment
+func (s *AttachmentService) signature(id int64, width int, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(fmt.Sprintf("%d:%d:%d", id, width, expires)))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifies the signed download URL parameters and opens the content of the attachment,
+// or of its thumbnail of the given width when width is not 0
+func (s *AttachmentService) open(ctx context.Context, id int64, width int, expires, signature string) (Attachment, io.ReadCloser, error) {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return Attachment{}, nil, errInvalidSignature
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(s.signature(id, width, exp))) {
+		return Attachment{}, nil, errInvalidSignature
+	}
+
+	attachment, err := s.repo.getAttachmentByID(ctx, id)
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+
+	if width != 0 {
+		i := slices.IndexFunc(attachment.Thumbnails, func(t Thumbnail) bool {
+			return t.Width == width
+		})
+		if i < 0 {
+			return Attachment{}, nil, errThumbnailNotFound
+		}
+
+		thumbnail := attachment.Thumbnails[i]
+		attachment.StorageKey = thumbnail.StorageKey
+		attachment.MimeType = thumbnail.MimeType
+		attachment.Size = thumbnail.Size
+	}
+
+	content, err := s.storage.get(ctx, attachment.StorageKey)
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+
+	return attachment, content, nil
+}
@@ -0,0 +1,167 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/guregu/null"
+)
+
+var (
+	errAttachmentNotFound = errors.New("attachment not found")
+	errThumbnailNotFound  = errors.New("thumbnail not found")
+)
+
+type Attachment struct {
+	ID         int64     `json:"id"`
+	UploaderID int64     `json:"uploader_id"`
+	MessageID  null.Int  `json:"message_id"`
+	StorageKey string    `json:"-"`
+	Filename   string    `json:"filename"`
+	MimeType   string    `json:"mime_type"`
+	Size       int64     `json:"size"`
+	Checksum   string    `json:"checksum"` // hex encoded SHA-256
+	Width      null.Int  `json:"width"`
+	Height     null.Int  `json:"height"`
+	CreatedAt  time.Time `json:"created_at"`
+	URL        string    `json:"url,omitempty"` // signed download URL
+
+	// set once images are processed in the background
+	Blurhash    null.String `json:"blurhash"`
+	Thumbnails  []Thumbnail `json:"thumbnails"`
+	ProcessedAt null.Time   `json:"processed_at"`
+}
+
+type Thumbnail struct {
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	MimeType   string `json:"mime_type"`
+	Size       int64  `json:"size"`
+	StorageKey string `json:"storage_key,omitempty"` // cleared in responses
+	URL        string `json:"url,omitempty"`         // signed download URL
+}
+
+type AttachmentsRepository interface {
+	createAttachment(ctx context.Context, a Attachment) (Attachment, error)
+	getAttachmentByID(ctx context.Context, id int64) (Attachment, error)
+	getAttachmentsByMessageIDs(ctx context.Context, messageIDs []int64) (map[int64][]Attachment, error)
+	getUploadedSize(ctx context.Context, uploaderID int64) (int64, error)
+	saveAttachmentProcessing(ctx context.Context, id int64, blurhash null.String, thumbnails []Thumbnail) (null.Int, error)
+}
+
+type AttachmentsRepositoryPostgreSQL struct {
+	db *sql.DB
+}
+
+func NewAttachmentsRepositoryPostgreSQL(db *sql.DB) *AttachmentsRepositoryPostgreSQL {
+	return &AttachmentsRepositoryPostgreSQL{
+		db: db,
+	}
+}
+
+const attachmentColumns = "id, uploader_id, message_id, storage_key, filename, mime_type, size, checksum, width, height, created_at, blurhash, thumbnails, processed_at"
+
+func scanAttachment(row rowScanner) (Attachment, error) {
+	var a Attachment
+	var thumbnails []byte
+
+	err := row.Scan(&a.ID, &a.UploaderID, &a.MessageID, &a.StorageKey, &a.Filename, &a.MimeType, &a.Size, &a.Checksum, &a.Width, &a.Height, &a.CreatedAt, &a.Blurhash, &thumbnails, &a.ProcessedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Attachment{}, errAttachmentNotFound
+	}
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	if err := json.Unmarshal(thumbnails, &a.Thumbnails); err != nil {
+		return Attachment{}, err
+	}
+
+	return a, nil
+}
+
+func (r *AttachmentsRepositoryPostgreSQL) createAttachment(ctx context.Context, a Attachment) (Attachment, error) {
+	row := r.db.QueryRowContext(ctx,
+		`INSERT INTO attachments (uploader_id, storage_key, filename, mime_type, size, checksum, width, height)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING `+attachmentColumns,
+		a.UploaderID, a.StorageKey, a.Filename, a.MimeType, a.Size, a.Checksum, a.Width, a.Height,
+	)
+
+	return scanAttachment(row)
+}
+
+func (r *AttachmentsRepositoryPostgreSQL) getAttachmentByID(ctx context.Context, id int64) (Attachment, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+attachmentColumns+` FROM attachments WHERE id = $1 AND deleted_at IS NULL`, id)
+
+	return scanAttachment(row)
+}
+
+// returns attachments keyed by message id
+func (r *AttachmentsRepositoryPostgreSQL) getAttachmentsByMessageIDs(ctx context.Context, messageIDs []int64) (map[int64][]Attachment, error) {
+	results := map[int64][]Attachment{}
+
+	if len(messageIDs) == 0 {
+		return results, nil
+	}
+
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+attachmentColumns+` FROM attachments
+		WHERE message_id = ANY($1) AND deleted_at IS NULL
+		ORDER BY id`,
+		messageIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		results[a.MessageID.Int64] = append(results[a.MessageID.Int64], a)
+	}
+
+	return results, rows.Err()
+}
+
+// returns the total bytes of attachments uploaded by the user, used to enforce quotas
+func (r *AttachmentsRepositoryPostgreSQL) getUploadedSize(ctx context.Context, uploaderID int64) (int64, error) {
+	var size int64
+
+	err := r.db.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(size), 0) FROM attachments WHERE uploader_id = $1 AND deleted_at IS NULL`,
+		uploaderID,
+	).Scan(&size)
+
+	return size, err
+}
+
+// stores the results of the image processing and returns the message the attachment was sent with, if any.
+// Sending a message locks the same row, so either the message is sent with the thumbnails
+// or the message id is returned here to notify its recipients.
+func (r *AttachmentsRepositoryPostgreSQL) saveAttachmentProcessing(ctx context.Context, id int64, blurhash null.String, thumbnails []Thumbnail) (null.Int, error) {
+	data, err := json.Marshal(thumbnails)
+	if err != nil {
+		return null.Int{}, err
+	}
+
+	var messageID null.Int
+
+	err = r.db.QueryRowContext(ctx,
+		`UPDATE attachments SET blurhash = $2, thumbnails = $3, processed_at = NOW()
+		WHERE id = $1
+		RETURNING message_id`,
+		id, blurhash, string(data),
+	).Scan(&messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return null.Int{}, errAttachmentNotFound
+	}
+
+	return messageID, err
+}
@@ -0,0 +1,109 @@
+package mig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	multipartMemory = 8 << 20 // bytes of a multipart form kept in memory, the rest is written to temporary files
+	uploadOverhead  = 1 << 20 // bytes allowed on top of the attachment for multipart headers and boundaries
+)
+
+// form fields
+//   - file : the attachment (required)
+func (c *APIController) uploadAttachment(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	if err := r.ParseMultipartForm(multipartMemory); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid multipart form")
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("missing file field")
+	}
+	defer file.Close()
+
+	attachment, err := c.attachments.upload(context.Background(), u, header.Filename, file, header.Size)
+	if err != nil {
+		return messageError(err)
+	}
+
+	c.images.enqueue(attachment)
+
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(attachment); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusCreated, nil
+}
+
+func (c *APIController) getAttachment(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid attachment id")
+	}
+
+	attachment, err := c.messages.attachment(context.Background(), u, id)
+	if err != nil {
+		return messageError(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(attachment); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// query params
+//   - expires : unix time (required)
+//   - signature : hex encoded (required)
+func (c *APIController) downloadAttachment(w http.ResponseWriter, r *http.Request) (int, error) {
+	return c.download(w, r, 0)
+}
+
+// same query params as downloadAttachment
+func (c *APIController) downloadThumbnail(w http.ResponseWriter, r *http.Request) (int, error) {
+	width, err := strconv.Atoi(chi.URLParam(r, "width"))
+	if err != nil || width <= 0 {
+		return http.StatusBadRequest, fmt.Errorf("invalid thumbnail width")
+	}
+
+	return c.download(w, r, width)
+}
+
+func (c *APIController) download(w http.ResponseWriter, r *http.Request, width int) (int, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid attachment id")
+	}
+
+	attachment, content, err := c.attachments.open(r.Context(), id, width, r.URL.Query().Get("expires"), r.URL.Query().Get("signature"))
+	if err != nil {
+		return messageError(err)
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", attachment.MimeType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+
+	if _, err := io.Copy(w, content); err != nil {
+		log.Error().Msg(err.Error())
+	}
+
+	return http.StatusOK, nil
+}
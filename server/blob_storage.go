@@ -0,0 +1,101 @@
+package mig
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStorage stores attachment contents by key.
+type BlobStorage interface {
+	put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	get(ctx context.Context, key string) (io.ReadCloser, error)
+	delete(ctx context.Context, key string) error
+}
+
+// BlobStorageLocal stores blobs as files under a directory.
+type BlobStorageLocal struct {
+	dir string
+}
+
+func NewBlobStorageLocal(dir string) (*BlobStorageLocal, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	return &BlobStorageLocal{
+		dir: dir,
+	}, nil
+}
+
+func (s *BlobStorageLocal) path(key string) (string, error) {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+
+	if !strings.HasPrefix(path, filepath.Clean(s.dir)+string(filepath.Separator)) {
+		return "", errors.New("invalid blob key")
+	}
+
+	return path, nil
+}
+
+// writes to a temporary file renamed once complete so partial blobs are never read
+func (s *BlobStorageLocal) put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *BlobStorageLocal) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+
+	return f, err
+}
+
+func (s *BlobStorageLocal) delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,74 @@
+package mig
+
+import (
+	"context"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// BlobStorageS3 stores blobs in a bucket of an S3 compatible service such as AWS S3 or MinIO.
+type BlobStorageS3 struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewBlobStorageS3(ctx context.Context, endpoint, region, accessKey, secretKey, bucket string, useSSL bool) (*BlobStorageS3, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+		Region: region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: region}); err != nil {
+			return nil, err
+		}
+	}
+
+	return &BlobStorageS3{
+		client: client,
+		bucket: bucket,
+	}, nil
+}
+
+func (s *BlobStorageS3) put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+
+	return err
+}
+
+func (s *BlobStorageS3) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject is lazy, stat to report missing objects before streaming
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, errBlobNotFound
+		}
+
+		return nil, err
+	}
+
+	return object, nil
+}
+
+func (s *BlobStorageS3) delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -45,6 +47,8 @@ func main() {
 				Aliases: []string{"s"},
 				Flags: []cli.Flag{
 					&cli.StringFlag{Name: "addr", Value: "localhost:8080", EnvVars: []string{"MIG_ADDR"}, Usage: "host:port address of the server"},
+					&cli.StringFlag{Name: "metrics_addr", Value: "localhost:9090", EnvVars: []string{"MIG_METRICS_ADDR"}, Usage: "host:port address of the internal listener of metrics, metrics are not served when empty"},
+					&cli.StringFlag{Name: "trusted_proxies", EnvVars: []string{"MIG_TRUSTED_PROXIES"}, Usage: "CIDRs of the reverse proxies whose X-Forwarded-For and X-Real-IP headers are honoured, as a comma separated list"},
 					&cli.StringFlag{Name: "environment", Value: "dev", EnvVars: []string{"MIG_ENVIRONMENT"}, Usage: "deployment environnment (dev, prod) of the server"},
 					&cli.StringFlag{Name: "jwt_secret", Value: "devdev", EnvVars: []string{"MIG_JWT_SECRET"}, Usage: "secret to sign JWT"},
 
@@ -57,9 +61,96 @@ func main() {
 
 					&cli.StringFlag{Name: "kafka_brokers", Value: "localhost:9092", EnvVars: []string{"MIG_KAFKA_BROKERS"}, Usage: "Kafka brokers to connect to, as a comma separated list"},
 					&cli.StringFlag{Name: "kafka_group", Value: uuid.NewString(), EnvVars: []string{"MIG_KAFKA_GROUP"}, Usage: "Kafka consumer group definition"},
-					&cli.StringFlag{Name: "kafka_topics", Value: "private,group", EnvVars: []string{"MIG_KAFKA_TOPICS"}, Usage: "Kafka topics, as a comma separated list"},
+					&cli.StringFlag{Name: "kafka_topic", Value: "mig.events", EnvVars: []string{"MIG_KAFKA_TOPIC"}, Usage: "Kafka topic of events, partitioned by conversation"},
 					&cli.StringFlag{Name: "kafka_version", Value: sarama.DefaultVersion.String(), EnvVars: []string{"MIG_KAFKA_VERSION"}, Usage: "Kafka cluster version"},
 					&cli.StringFlag{Name: "kafka_assignor", Value: "range", EnvVars: []string{"MIG_KAFKA_ASSIGNOR"}, Usage: "Kafka consumer group partition assignment strategy (range, roundrobin, sticky)"},
+					&cli.StringFlag{Name: "kafka_dlq_topic", Value: "mig.dlq", EnvVars: []string{"MIG_KAFKA_DLQ_TOPIC"}, Usage: "Kafka topic of records the consumer cannot process"},
+					&cli.IntFlag{Name: "kafka_max_attempts", Value: 5, EnvVars: []string{"MIG_KAFKA_MAX_ATTEMPTS"}, Usage: "deliveries of a Kafka record before it is sent to the dead-letter topic"},
+					&cli.DurationFlag{Name: "kafka_retry_backoff", Value: 500 * time.Millisecond, EnvVars: []string{"MIG_KAFKA_RETRY_BACKOFF"}, Usage: "wait after the first failed delivery of a Kafka record, doubled after each attempt"},
+
+					&cli.DurationFlag{Name: "shutdown_timeout", Value: 30 * time.Second, EnvVars: []string{"MIG_SHUTDOWN_TIMEOUT"}, Usage: "time allowed to close websocket connections and drain the message broker on shutdown"},
+
+					&cli.Int64Flag{Name: "ws_read_limit", Value: 16384, EnvVars: []string{"MIG_WS_READ_LIMIT"}, Usage: "maximum size in bytes of a websocket frame read from clients"},
+					&cli.IntFlag{Name: "ws_read_buffer_size", Value: 1024, EnvVars: []string{"MIG_WS_READ_BUFFER_SIZE"}, Usage: "read buffer size in bytes of a websocket connection, kept by the connection while it is open"},
+					&cli.IntFlag{Name: "ws_write_buffer_size", Value: 4096, EnvVars: []string{"MIG_WS_WRITE_BUFFER_SIZE"}, Usage: "write buffer size in bytes, write buffers are pooled between websocket connections"},
+					&cli.BoolFlag{Name: "ws_compression", Value: true, EnvVars: []string{"MIG_WS_COMPRESSION"}, Usage: "negotiate permessage-deflate with websocket clients offering it"},
+					&cli.IntFlag{Name: "ws_compression_level", Value: 1, EnvVars: []string{"MIG_WS_COMPRESSION_LEVEL"}, Usage: "flate level of websocket compression, from 1 (fastest) to 9 (smallest)"},
+					&cli.IntFlag{Name: "ws_queue_size", Value: 256, EnvVars: []string{"MIG_WS_QUEUE_SIZE"}, Usage: "events queued per websocket connection before the overflow policy applies"},
+					&cli.StringFlag{Name: "ws_overflow", Value: "drop_oldest", EnvVars: []string{"MIG_WS_OVERFLOW"}, Usage: "policy of websocket connections with a full queue (drop_oldest, disconnect, inbox)"},
+					&cli.IntFlag{Name: "ws_replay_limit", Value: 1000, EnvVars: []string{"MIG_WS_REPLAY_LIMIT"}, Usage: "events replayed to a resumed websocket session, clients further behind fetch the history"},
+					&cli.DurationFlag{Name: "ws_session_ttl", Value: 24 * time.Hour, EnvVars: []string{"MIG_WS_SESSION_TTL"}, Usage: "time a websocket session can be resumed after its last connection"},
+					&cli.IntFlag{Name: "ws_write_batch", Value: 1, EnvVars: []string{"MIG_WS_WRITE_BATCH"}, Usage: "queued events coalesced in a websocket frame, separated by newlines"},
+
+					&cli.StringFlag{Name: "rate_limit_store", Value: "memory", EnvVars: []string{"MIG_RATE_LIMIT_STORE"}, Usage: "store of rate limits (memory, redis), redis enforces limits across servers"},
+					&cli.DurationFlag{Name: "http_rate_period", Value: time.Minute, EnvVars: []string{"MIG_HTTP_RATE_PERIOD"}, Usage: "period of HTTP rate limits"},
+					&cli.IntFlag{Name: "http_ip_limit", Value: 600, EnvVars: []string{"MIG_HTTP_IP_LIMIT"}, Usage: "API requests per period from an IP, unlimited when 0"},
+					&cli.IntFlag{Name: "http_user_limit", Value: 300, EnvVars: []string{"MIG_HTTP_USER_LIMIT"}, Usage: "API requests per period by a user, unlimited when 0"},
+					&cli.IntFlag{Name: "http_strict_ip_limit", Value: 60, EnvVars: []string{"MIG_HTTP_STRICT_IP_LIMIT"}, Usage: "requests per period from an IP to routes with strict limits such as uploads and search, unlimited when 0"},
+					&cli.IntFlag{Name: "http_strict_user_limit", Value: 30, EnvVars: []string{"MIG_HTTP_STRICT_USER_LIMIT"}, Usage: "requests per period by a user to routes with strict limits such as uploads and search, unlimited when 0"},
+					&cli.DurationFlag{Name: "ws_rate_period", Value: 10 * time.Second, EnvVars: []string{"MIG_WS_RATE_PERIOD"}, Usage: "period of websocket rate limits"},
+					&cli.IntFlag{Name: "ws_message_limit", Value: 20, EnvVars: []string{"MIG_WS_MESSAGE_LIMIT"}, Usage: "messages sent, edited or deleted per period on a websocket connection, unlimited when 0"},
+					&cli.IntFlag{Name: "ws_event_limit", Value: 50, EnvVars: []string{"MIG_WS_EVENT_LIMIT"}, Usage: "reactions and ephemeral events per period on a websocket connection, unlimited when 0"},
+					&cli.IntFlag{Name: "ws_user_message_limit", Value: 40, EnvVars: []string{"MIG_WS_USER_MESSAGE_LIMIT"}, Usage: "messages sent, edited or deleted per period by a user on all connections, unlimited when 0"},
+					&cli.IntFlag{Name: "ws_user_event_limit", Value: 100, EnvVars: []string{"MIG_WS_USER_EVENT_LIMIT"}, Usage: "reactions and ephemeral events per period by a user on all connections, unlimited when 0"},
+					&cli.IntFlag{Name: "ws_max_violations", Value: 10, EnvVars: []string{"MIG_WS_MAX_VIOLATIONS"}, Usage: "rate limited events in a row before a websocket connection is closed, never closed when 0"},
+
+					&cli.StringFlag{Name: "broker", Value: "nats", EnvVars: []string{"MIG_BROKER"}, Usage: "message broker of events between nodes (nats, redis, kafka)"},
+
+					&cli.StringFlag{Name: "nats_mode", Value: "core", EnvVars: []string{"MIG_NATS_MODE"}, Usage: "NATS broker mode (core, jetstream), jetstream stores events until every node acknowledged them"},
+					&cli.StringFlag{Name: "nats_stream", Value: "MIG", EnvVars: []string{"MIG_NATS_STREAM"}, Usage: "JetStream stream of events"},
+					&cli.StringFlag{Name: "nats_durable", Value: hostname(), EnvVars: []string{"MIG_NATS_DURABLE"}, Usage: "JetStream durable consumer name, unique per node"},
+					&cli.DurationFlag{Name: "nats_inactive_threshold", Value: time.Hour, EnvVars: []string{"MIG_NATS_INACTIVE_THRESHOLD"}, Usage: "JetStream time before the durable consumer of a stopped node is deleted, kept forever when 0"},
+					&cli.IntFlag{Name: "nats_max_deliver", Value: 5, EnvVars: []string{"MIG_NATS_MAX_DELIVER"}, Usage: "JetStream deliveries of an event before it is dropped"},
+					&cli.DurationFlag{Name: "nats_ack_wait", Value: 30 * time.Second, EnvVars: []string{"MIG_NATS_ACK_WAIT"}, Usage: "JetStream time before an unacknowledged event is redelivered"},
+					&cli.DurationFlag{Name: "nats_stream_max_age", Value: 24 * time.Hour, EnvVars: []string{"MIG_NATS_STREAM_MAX_AGE"}, Usage: "JetStream retention of events, kept forever when 0"},
+					&cli.Int64Flag{Name: "nats_stream_max_bytes", Value: -1, EnvVars: []string{"MIG_NATS_STREAM_MAX_BYTES"}, Usage: "JetStream stream size before the oldest events are removed, unlimited when -1"},
+					&cli.Int64Flag{Name: "nats_stream_max_msgs", Value: -1, EnvVars: []string{"MIG_NATS_STREAM_MAX_MSGS"}, Usage: "JetStream events kept before the oldest are removed, unlimited when -1"},
+					&cli.IntFlag{Name: "nats_stream_replicas", Value: 1, EnvVars: []string{"MIG_NATS_STREAM_REPLICAS"}, Usage: "JetStream copies of the stream in a cluster"},
+
+					&cli.StringFlag{Name: "redis_addr", Value: "localhost:6379", EnvVars: []string{"MIG_REDIS_ADDR"}, Usage: "host:port of the Redis server"},
+					&cli.StringFlag{Name: "redis_password", EnvVars: []string{"MIG_REDIS_PASSWORD"}, Usage: "Redis password"},
+					&cli.IntFlag{Name: "redis_db", Value: 0, EnvVars: []string{"MIG_REDIS_DB"}, Usage: "Redis database"},
+					&cli.StringFlag{Name: "redis_stream", Value: "mig:events", EnvVars: []string{"MIG_REDIS_STREAM"}, Usage: "Redis stream of events"},
+					&cli.StringFlag{Name: "redis_channel", Value: "mig:ephemeral", EnvVars: []string{"MIG_REDIS_CHANNEL"}, Usage: "Redis Pub/Sub channel of ephemeral events such as typing"},
+					&cli.StringFlag{Name: "redis_group", Value: hostname(), EnvVars: []string{"MIG_REDIS_GROUP"}, Usage: "Redis consumer group, unique per node"},
+					&cli.Int64Flag{Name: "redis_stream_max_len", Value: 100000, EnvVars: []string{"MIG_REDIS_STREAM_MAX_LEN"}, Usage: "approximate number of events kept in the Redis stream"},
+					&cli.Int64Flag{Name: "redis_batch_size", Value: 100, EnvVars: []string{"MIG_REDIS_BATCH_SIZE"}, Usage: "events read from the Redis stream at once"},
+					&cli.DurationFlag{Name: "redis_claim_min_idle", Value: 30 * time.Second, EnvVars: []string{"MIG_REDIS_CLAIM_MIN_IDLE"}, Usage: "time before events pending on a crashed process are reclaimed"},
+					&cli.DurationFlag{Name: "redis_claim_interval", Value: 10 * time.Second, EnvVars: []string{"MIG_REDIS_CLAIM_INTERVAL"}, Usage: "time between reclaims of pending events"},
+					&cli.Int64Flag{Name: "redis_max_deliver", Value: 5, EnvVars: []string{"MIG_REDIS_MAX_DELIVER"}, Usage: "deliveries of a Redis stream event before it is dropped, retried forever when 0"},
+					&cli.DurationFlag{Name: "redis_group_ttl", Value: time.Hour, EnvVars: []string{"MIG_REDIS_GROUP_TTL"}, Usage: "idle time before the Redis consumer group of a stopped node is destroyed, kept forever when 0"},
+
+					&cli.StringFlag{Name: "storage", Value: "local", EnvVars: []string{"MIG_STORAGE"}, Usage: "blob storage of attachments (local, s3)"},
+					&cli.StringFlag{Name: "storage_dir", Value: "data", EnvVars: []string{"MIG_STORAGE_DIR"}, Usage: "directory of the local blob storage"},
+					&cli.StringFlag{Name: "storage_s3_endpoint", Value: "localhost:9000", EnvVars: []string{"MIG_STORAGE_S3_ENDPOINT"}, Usage: "host:port of the S3 compatible blob storage"},
+					&cli.StringFlag{Name: "storage_s3_region", Value: "ap-southeast-2", EnvVars: []string{"MIG_STORAGE_S3_REGION"}, Usage: "region of the S3 bucket"},
+					&cli.StringFlag{Name: "storage_s3_access_key", Value: "minioadmin", EnvVars: []string{"MIG_STORAGE_S3_ACCESS_KEY"}, Usage: "S3 access key"},
+					&cli.StringFlag{Name: "storage_s3_secret_key", Value: "minioadmin", EnvVars: []string{"MIG_STORAGE_S3_SECRET_KEY"}, Usage: "S3 secret key"},
+					&cli.StringFlag{Name: "storage_s3_bucket", Value: "mig", EnvVars: []string{"MIG_STORAGE_S3_BUCKET"}, Usage: "S3 bucket of attachments"},
+					&cli.BoolFlag{Name: "storage_s3_ssl", Value: false, EnvVars: []string{"MIG_STORAGE_S3_SSL"}, Usage: "connect to the S3 endpoint over TLS"},
+
+					&cli.StringFlag{Name: "attachments_secret", Value: "devdev", EnvVars: []string{"MIG_ATTACHMENTS_SECRET"}, Usage: "secret to sign attachment download URLs"},
+					&cli.DurationFlag{Name: "attachments_url_ttl", Value: 5 * time.Minute, EnvVars: []string{"MIG_ATTACHMENTS_URL_TTL"}, Usage: "validity of signed attachment download URLs"},
+					&cli.Int64Flag{Name: "attachments_max_size", Value: 25 << 20, EnvVars: []string{"MIG_ATTACHMENTS_MAX_SIZE"}, Usage: "maximum size in bytes of an attachment"},
+					&cli.Int64Flag{Name: "attachments_quota", Value: 1 << 30, EnvVars: []string{"MIG_ATTACHMENTS_QUOTA"}, Usage: "maximum size in bytes of all attachments uploaded by a user"},
+
+					&cli.IntFlag{Name: "images_workers", Value: 4, EnvVars: []string{"MIG_IMAGES_WORKERS"}, Usage: "number of workers generating thumbnails of image attachments"},
+					&cli.IntFlag{Name: "images_queue_size", Value: 100, EnvVars: []string{"MIG_IMAGES_QUEUE_SIZE"}, Usage: "image attachments waiting for thumbnails before new uploads are left unprocessed"},
+
+					&cli.DurationFlag{Name: "scheduler_interval", Value: 5 * time.Second, EnvVars: []string{"MIG_SCHEDULER_INTERVAL"}, Usage: "time between polls of due scheduled messages"},
+					&cli.IntFlag{Name: "scheduler_batch_size", Value: 100, EnvVars: []string{"MIG_SCHEDULER_BATCH_SIZE"}, Usage: "due scheduled messages sent per transaction"},
+
+					&cli.DurationFlag{Name: "reaper_interval", Value: 30 * time.Second, EnvVars: []string{"MIG_REAPER_INTERVAL"}, Usage: "time between deletions of expired messages"},
+					&cli.IntFlag{Name: "reaper_batch_size", Value: 500, EnvVars: []string{"MIG_REAPER_BATCH_SIZE"}, Usage: "expired messages deleted per transaction"},
+
+					&cli.DurationFlag{Name: "outbox_interval", Value: 200 * time.Millisecond, EnvVars: []string{"MIG_OUTBOX_INTERVAL"}, Usage: "time between polls of the outbox for events to publish"},
+					&cli.IntFlag{Name: "outbox_batch_size", Value: 100, EnvVars: []string{"MIG_OUTBOX_BATCH_SIZE"}, Usage: "outbox events published per transaction"},
+					&cli.DurationFlag{Name: "outbox_max_backoff", Value: time.Minute, EnvVars: []string{"MIG_OUTBOX_MAX_BACKOFF"}, Usage: "longest wait before retrying to publish a failed outbox event"},
+					&cli.IntFlag{Name: "outbox_max_attempts", Value: 20, EnvVars: []string{"MIG_OUTBOX_MAX_ATTEMPTS"}, Usage: "publish attempts of an outbox event before it is parked as failed"},
+					&cli.DurationFlag{Name: "outbox_retention", Value: 24 * time.Hour, EnvVars: []string{"MIG_OUTBOX_RETENTION"}, Usage: "time published outbox events are kept"},
+
+					&cli.DurationFlag{Name: "message_edit_window", Value: 15 * time.Minute, EnvVars: []string{"MIG_MESSAGE_EDIT_WINDOW"}, Usage: "time after sending during which a message can be edited or deleted by its sender"},
+					&cli.IntFlag{Name: "pin_limit", Value: 50, EnvVars: []string{"MIG_PIN_LIMIT"}, Usage: "maximum number of pinned messages per conversation"},
 				},
 				Action: func(c *cli.Context) error {
 					err := serve(c)
@@ -69,12 +160,64 @@ func main() {
 					return err
 				},
 			},
+			{
+				Name:  "dlq",
+				Usage: "inspect and replay records of the Kafka dead-letter topic",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "kafka_brokers", Value: "localhost:9092", EnvVars: []string{"MIG_KAFKA_BROKERS"}, Usage: "Kafka brokers to connect to, as a comma separated list"},
+					&cli.StringFlag{Name: "kafka_version", Value: sarama.DefaultVersion.String(), EnvVars: []string{"MIG_KAFKA_VERSION"}, Usage: "Kafka cluster version"},
+					&cli.StringFlag{Name: "kafka_dlq_topic", Value: "mig.dlq", EnvVars: []string{"MIG_KAFKA_DLQ_TOPIC"}, Usage: "Kafka topic of records the consumer cannot process"},
+					&cli.IntFlag{Name: "partition", Value: -1, Usage: "partition to read, all partitions when negative"},
+					&cli.Int64Flag{Name: "offset", Value: 0, Usage: "first offset to read in each partition"},
+					&cli.IntFlag{Name: "limit", Value: 0, Usage: "maximum number of records to read, all records when 0"},
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:  "inspect",
+						Usage: "print dead-lettered records as JSON lines",
+						Action: func(c *cli.Context) error {
+							return withDeadLetterReader(c, func(r *mig.DeadLetterReader) error {
+								return r.Inspect(c.Context, os.Stdout, int32(c.Int("partition")), c.Int64("offset"), c.Int("limit"))
+							})
+						},
+					},
+					{
+						Name:  "replay",
+						Usage: "produce dead-lettered records again on their original topic",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "topic", Usage: "topic to replay the records on instead of their original topic"},
+						},
+						Action: func(c *cli.Context) error {
+							return withDeadLetterReader(c, func(r *mig.DeadLetterReader) error {
+								replayed, err := r.Replay(c.Context, c.String("topic"), int32(c.Int("partition")), c.Int64("offset"), c.Int("limit"))
+								log.Info().Msg(fmt.Sprintf("replayed %d records", replayed))
+								return err
+							})
+						},
+					},
+				},
+			},
 		},
 	}
 
 	app.Run(os.Args)
 }
 
+func withDeadLetterReader(c *cli.Context, fn func(r *mig.DeadLetterReader) error) error {
+	version, err := sarama.ParseKafkaVersion(c.String("kafka_version"))
+	if err != nil {
+		return err
+	}
+
+	reader, err := mig.NewDeadLetterReader(strings.Split(c.String("kafka_brokers"), ","), version, c.String("kafka_dlq_topic"))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return fn(reader)
+}
+
 func serve(c *cli.Context) error {
 	addr := c.String("addr")
 	if addr == "" {
@@ -121,7 +264,25 @@ func serve(c *cli.Context) error {
 		return fmt.Errorf("missing env: MIG_DATABASE_APPLICATION_NAME")
 	}
 
-	nats, err := mig.NewNats("ws", "mig", "devdev", "localhost", "89")
+	editWindow := c.Duration("message_edit_window")
+	if editWindow <= 0 {
+		return fmt.Errorf("invalid env: MIG_MESSAGE_EDIT_WINDOW")
+	}
+
+	pinLimit := c.Int("pin_limit")
+	if pinLimit <= 0 {
+		return fmt.Errorf("invalid env: MIG_PIN_LIMIT")
+	}
+
+	attachmentsSecret := c.String("attachments_secret")
+	if attachmentsSecret == "" {
+		return fmt.Errorf("missing env: MIG_ATTACHMENTS_SECRET")
+	}
+
+	storage, err := newBlobStorage(c)
+	if err != nil {
+		return err
+	}
 
 	db, err := mig.NewDBConnection(dbUser, dbPass, dbHost, dbPort, dbName, dbAppName, version)
 	if err != nil {
@@ -131,13 +292,88 @@ func serve(c *cli.Context) error {
 	auther := mig.NewAuther(jwtSecret, addr)
 
 	groupsRepo := mig.NewGroupsRepositoryPostgreSQL(db)
+	messagesRepo := mig.NewMessagesRepositoryPostgreSQL(db)
+	attachmentsRepo := mig.NewAttachmentsRepositoryPostgreSQL(db)
+
+	attachments := mig.NewAttachmentService(attachmentsRepo, storage, attachmentsSecret, c.Duration("attachments_url_ttl"), c.Int64("attachments_max_size"), c.Int64("attachments_quota"))
+	messages := mig.NewMessageService(messagesRepo, groupsRepo, attachments, editWindow, pinLimit)
+
+	// stopped first on shutdown, the events they write are relayed before the broker is drained
+	workers := newWorkerGroup(c.Context)
+	defer workers.stop()
+
+	images := mig.NewImageProcessor(attachments, messages, c.Int("images_workers"), c.Int("images_queue_size"))
+	workers.run(images.Run)
 
-	hub := mig.NewHub(nats)
-	go hub.Run(c.Context)
+	scheduledMessagesRepo := mig.NewScheduledMessagesRepositoryPostgreSQL(db)
 
-	controller := mig.NewAPIController(db, auther, hub, groupsRepo)
+	scheduler := mig.NewScheduler(scheduledMessagesRepo, messages, c.Duration("scheduler_interval"), c.Int("scheduler_batch_size"))
+	workers.run(scheduler.Run)
 
-	router := mig.NewRouter(controller)
+	reaper := mig.NewReaper(messagesRepo, messages, storage, c.Duration("reaper_interval"), c.Int("reaper_batch_size"))
+	workers.run(reaper.Run)
+
+	broker, subscribe, drain, err := newBroker(c)
+	if err != nil {
+		return err
+	}
+
+	relayCtx, stopRelay := context.WithCancel(c.Context)
+	defer stopRelay()
+
+	relay := mig.NewOutboxRelay(db, broker, c.Duration("outbox_interval"), c.Int("outbox_batch_size"), c.Duration("outbox_max_backoff"), c.Int("outbox_max_attempts"), c.Duration("outbox_retention"))
+	go relay.Run(relayCtx)
+
+	sessionsRepo := mig.NewSessionsRepositoryPostgreSQL(db)
+
+	rateLimitStore, err := newRateLimitStore(c)
+	if err != nil {
+		return err
+	}
+
+	devicesRepo := mig.NewDevicesRepositoryPostgreSQL(db)
+
+	hub, err := mig.NewHub(messages, sessionsRepo, devicesRepo, c.Int("ws_queue_size"), mig.OverflowPolicy(c.String("ws_overflow")), c.Int("ws_write_batch"), c.Int("ws_replay_limit"), c.Duration("ws_session_ttl"), mig.WebSocketRateLimits{
+		Store:         rateLimitStore,
+		Messages:      mig.RateLimit{Requests: c.Int("ws_message_limit"), Period: c.Duration("ws_rate_period")},
+		Events:        mig.RateLimit{Requests: c.Int("ws_event_limit"), Period: c.Duration("ws_rate_period")},
+		UserMessages:  mig.RateLimit{Requests: c.Int("ws_user_message_limit"), Period: c.Duration("ws_rate_period")},
+		UserEvents:    mig.RateLimit{Requests: c.Int("ws_user_event_limit"), Period: c.Duration("ws_rate_period")},
+		MaxViolations: c.Int("ws_max_violations"),
+	}, mig.WebSocketTransport{
+		ReadLimit:        c.Int64("ws_read_limit"),
+		ReadBufferSize:   c.Int("ws_read_buffer_size"),
+		WriteBufferSize:  c.Int("ws_write_buffer_size"),
+		Compression:      c.Bool("ws_compression"),
+		CompressionLevel: c.Int("ws_compression_level"),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := subscribe(hub, workers); err != nil {
+		return err
+	}
+
+	rateLimiter := mig.NewHTTPRateLimiter(rateLimitStore, map[string]mig.RateLimitGroup{
+		mig.RateLimitGroupDefault: {
+			IP:   mig.RateLimit{Requests: c.Int("http_ip_limit"), Period: c.Duration("http_rate_period")},
+			User: mig.RateLimit{Requests: c.Int("http_user_limit"), Period: c.Duration("http_rate_period")},
+		},
+		mig.RateLimitGroupStrict: {
+			IP:   mig.RateLimit{Requests: c.Int("http_strict_ip_limit"), Period: c.Duration("http_rate_period")},
+			User: mig.RateLimit{Requests: c.Int("http_strict_user_limit"), Period: c.Duration("http_rate_period")},
+		},
+	})
+
+	controller := mig.NewAPIController(db, auther, hub, groupsRepo, messagesRepo, messages, attachments, images, scheduler, rateLimiter, devicesRepo)
+
+	proxies, err := mig.ParseTrustedProxies(strings.Split(c.String("trusted_proxies"), ","))
+	if err != nil {
+		return err
+	}
+
+	router := mig.NewRouter(controller, proxies)
 
 	server := &http.Server{
 		Addr:    addr,
@@ -152,20 +388,238 @@ func serve(c *cli.Context) error {
 		}
 	}()
 
+	// metrics are served on an internal address only
+	metricsServer := &http.Server{
+		Addr:    c.String("metrics_addr"),
+		Handler: mig.NewMetricsRouter(),
+	}
+
+	if metricsServer.Addr != "" {
+		go func() {
+			err := metricsServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Error().Msg(err.Error())
+			}
+		}()
+	}
+
 	signalChan := make(chan os.Signal, 1)
 
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
 	signal := <-signalChan
 
-	ctx, cancel := context.WithTimeout(c.Context, time.Second*5)
+	ctx, cancel := context.WithTimeout(c.Context, c.Duration("shutdown_timeout"))
 	defer cancel()
 
-	log.Info().Msg(fmt.Sprintf("received signal %s, shutting down http server gracefully...", signal))
+	log.Info().Msg(fmt.Sprintf("received signal %s, stopping workers...", signal))
+	if err := workers.shutdown(ctx); err != nil {
+		log.Error().Msg(fmt.Sprintf("stop workers: %s", err.Error()))
+	}
+
+	// clients reconnect to other servers and resume their sessions. The hub shuts down alongside the
+	// http server since event streams of the HTTP fallbacks only return once their clients are closed.
+	hubShutdown := make(chan error, 1)
+	go func() {
+		hubShutdown <- hub.Shutdown(ctx)
+	}()
+
+	log.Info().Msg("shutting down http server gracefully...")
 	if err := server.Shutdown(ctx); err != nil {
-		log.Error().Msg(err.Error())
-		return err
+		log.Error().Msg(fmt.Sprintf("shutdown http server: %s", err.Error()))
+	}
+
+	metricsServer.Close()
+
+	if err := <-hubShutdown; err != nil {
+		log.Error().Msg(fmt.Sprintf("close websocket connections: %s", err.Error()))
+	}
+
+	// events of the batch being relayed are marked sent before the broker is drained
+	stopRelay()
+	select {
+	case <-relay.Done():
+	case <-ctx.Done():
+		log.Error().Msg(fmt.Sprintf("stop outbox relay: %s", ctx.Err().Error()))
+	}
+
+	log.Info().Msg("draining message broker...")
+	if err := drain(ctx); err != nil {
+		log.Error().Msg(fmt.Sprintf("drain message broker: %s", err.Error()))
+	}
+
+	return db.Close()
+}
+
+// background workers sharing a context canceled on shutdown
+type workerGroup struct {
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+func newWorkerGroup(parent context.Context) *workerGroup {
+	ctx, stop := context.WithCancel(parent)
+
+	return &workerGroup{
+		ctx:  ctx,
+		stop: stop,
+	}
+}
+
+// runs fn in a goroutine until the context of the workers is canceled
+func (w *workerGroup) run(fn func(ctx context.Context)) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		fn(w.ctx)
+	}()
+}
+
+// cancels the context of the workers and waits for them to return, or for ctx to be done
+func (w *workerGroup) shutdown(ctx context.Context) error {
+	w.stop()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// returns the broker selected by the broker flag, a function delivering its events to a hub and
+// a function waiting for the events being delivered before closing the broker. Consumers run as
+// workers when the broker has no subscription of its own.
+func newBroker(c *cli.Context) (mig.MessageBroker, func(hub *mig.Hub, workers *workerGroup) error, func(ctx context.Context) error, error) {
+	switch c.String("broker") {
+	case "nats":
+		nats, err := mig.NewNats("ws", "mig", "devdev", "localhost", "89")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		switch c.String("nats_mode") {
+		case "core":
+			return nats, func(hub *mig.Hub, workers *workerGroup) error {
+				nats.Subscribe("mig.messages.*", hub)
+				nats.Subscribe("mig.friendships.*", hub)
+				nats.Subscribe("mig.devices.*", hub)
+				return nil
+			}, nats.Drain, nil
+		case "jetstream":
+			jetStream, err := nats.JetStream(c.Context, mig.JetStreamConfig{
+				Stream:     c.String("nats_stream"),
+				Subjects:   []string{"mig.messages.*", "mig.friendships.*", "mig.devices.*"},
+				Durable:    c.String("nats_durable"),
+				MaxDeliver: c.Int("nats_max_deliver"),
+				AckWait:    c.Duration("nats_ack_wait"),
+				MaxAge:     c.Duration("nats_stream_max_age"),
+				MaxBytes:   c.Int64("nats_stream_max_bytes"),
+				MaxMsgs:    c.Int64("nats_stream_max_msgs"),
+				Replicas:   c.Int("nats_stream_replicas"),
+
+				InactiveThreshold: c.Duration("nats_inactive_threshold"),
+			})
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			return jetStream, func(hub *mig.Hub, workers *workerGroup) error {
+				return jetStream.Subscribe(c.Context, hub)
+			}, jetStream.Drain, nil
+		default:
+			return nil, nil, nil, fmt.Errorf("unrecognized NATS mode: %s", c.String("nats_mode"))
+		}
+	case "redis":
+		redis, err := mig.NewRedisBroker(c.Context, c.String("redis_addr"), c.String("redis_password"), c.Int("redis_db"), mig.RedisBrokerConfig{
+			Stream:        c.String("redis_stream"),
+			Channel:       c.String("redis_channel"),
+			Group:         c.String("redis_group"),
+			MaxLen:        c.Int64("redis_stream_max_len"),
+			BatchSize:     c.Int64("redis_batch_size"),
+			ClaimMinIdle:  c.Duration("redis_claim_min_idle"),
+			ClaimInterval: c.Duration("redis_claim_interval"),
+			MaxDeliver:    c.Int64("redis_max_deliver"),
+			GroupTTL:      c.Duration("redis_group_ttl"),
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return redis, func(hub *mig.Hub, workers *workerGroup) error {
+			return redis.Subscribe(c.Context, hub)
+		}, redis.Drain, nil
+	case "kafka":
+		version, err := sarama.ParseKafkaVersion(c.String("kafka_version"))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		kafka, err := mig.NewKafka(strings.Split(c.String("kafka_brokers"), ","), version, c.String("kafka_topic"), c.String("kafka_assignor"), c.String("kafka_group"))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		subscribe := func(hub *mig.Hub, workers *workerGroup) error {
+			consumer := mig.NewConsumer(hub, kafka.DeadLetterQueue(c.String("kafka_dlq_topic")), c.Int("kafka_max_attempts"), c.Duration("kafka_retry_backoff"))
+			workers.run(func(ctx context.Context) {
+				kafka.Consume(ctx, consumer)
+			})
+			return nil
+		}
+
+		// the consumer group is left once the records being delivered are committed
+		drain := func(ctx context.Context) error {
+			return kafka.Close()
+		}
+
+		return kafka, subscribe, drain, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unrecognized broker: %s", c.String("broker"))
+	}
+}
+
+func newRateLimitStore(c *cli.Context) (mig.RateLimitStore, error) {
+	switch c.String("rate_limit_store") {
+	case "memory":
+		return mig.NewRateLimitStoreMemory(), nil
+	case "redis":
+		return mig.NewRateLimitStoreRedis(c.Context, c.String("redis_addr"), c.String("redis_password"), c.Int("redis_db"), "mig:ratelimit:")
+	default:
+		return nil, fmt.Errorf("unrecognized rate limit store: %s", c.String("rate_limit_store"))
+	}
+}
+
+func newBlobStorage(c *cli.Context) (mig.BlobStorage, error) {
+	switch c.String("storage") {
+	case "local":
+		return mig.NewBlobStorageLocal(c.String("storage_dir"))
+	case "s3":
+		return mig.NewBlobStorageS3(
+			c.Context,
+			c.String("storage_s3_endpoint"),
+			c.String("storage_s3_region"),
+			c.String("storage_s3_access_key"),
+			c.String("storage_s3_secret_key"),
+			c.String("storage_s3_bucket"),
+			c.Bool("storage_s3_ssl"),
+		)
+	default:
+		return nil, fmt.Errorf("unrecognized storage: %s", c.String("storage"))
+	}
+}
+
+// default name of the node, dots are not allowed in JetStream consumer names
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "mig"
 	}
 
-	return nil
+	return strings.ReplaceAll(name, ".", "-")
 }
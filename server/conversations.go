@@ -0,0 +1,154 @@
+package mig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/guregu/null"
+)
+
+const maxMessageTTLSeconds = 365 * 24 * 60 * 60
+
+var (
+	errInvalidMessageTTL    = errors.New("message_ttl_seconds must be between 1 and 31536000, or null")
+	errConversationNotFound = errors.New("conversation not found")
+)
+
+// returns the key of the conversation of the message: the sorted user pair of private messages or the group id
+func conversationKey(m Message) string {
+	switch m.MessageType {
+	case MessageTypePrivate:
+		return fmt.Sprintf("private:%d:%d", min(m.SenderID, m.RecipientID), max(m.SenderID, m.RecipientID))
+	default:
+		return fmt.Sprintf("group:%d", m.RecipientID)
+	}
+}
+
+// returns a message of the user in the conversation, kind is private or group
+// and conversationID the other user id or the group id
+func conversationMessage(user User, kind MessageType, conversationID int64) Message {
+	return Message{
+		SenderID:    user.ID,
+		RecipientID: conversationID,
+		MessageType: kind,
+	}
+}
+
+// checks the user can read and write in the conversation, users are part of their private conversations
+// with any other active user
+func (s *MessageService) checkParticipant(ctx context.Context, user User, kind MessageType, conversationID int64) error {
+	switch kind {
+	case MessageTypePrivate:
+		if conversationID == user.ID {
+			return errConversationNotFound
+		}
+
+		exists, err := s.repo.activeUserExists(ctx, conversationID)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return errConversationNotFound
+		}
+
+		return nil
+	case MessageTypeGroup:
+		members, err := s.groupsRepo.getGroupMemberIDs(ctx, conversationID)
+		if err != nil {
+			return err
+		}
+
+		if !slices.Contains(members, user.ID) {
+			return errNotParticipant
+		}
+
+		return nil
+	default:
+		return errInvalidMessageType
+	}
+}
+
+func (s *MessageService) settings(ctx context.Context, user User, kind MessageType, conversationID int64) (ConversationSettings, error) {
+	if err := s.checkParticipant(ctx, user, kind, conversationID); err != nil {
+		return ConversationSettings{}, err
+	}
+
+	return s.repo.getConversationSettings(ctx, conversationKey(conversationMessage(user, kind, conversationID)))
+}
+
+// sets the time after which new messages of the conversation are deleted and announces it in the conversation
+func (s *MessageService) setMessageTTL(ctx context.Context, user User, kind MessageType, conversationID int64, ttl null.Int) (ConversationSettings, error) {
+	if ttl.Valid && (ttl.Int64 <= 0 || ttl.Int64 > maxMessageTTLSeconds) {
+		return ConversationSettings{}, errInvalidMessageTTL
+	}
+
+	if err := s.checkParticipant(ctx, user, kind, conversationID); err != nil {
+		return ConversationSettings{}, err
+	}
+
+	m := conversationMessage(user, kind, conversationID)
+	if kind == MessageTypeGroup {
+		m.MessageType = MessageTypeSystem
+	}
+
+	m.System = &SystemEvent{
+		Type:              SystemEventTypeMessageTTLChanged,
+		ActorID:           user.ID,
+		MessageTTLSeconds: ttl,
+	}
+
+	return s.repo.setConversationMessageTTL(ctx, m, ttl, s.event(subjectMessagesCreated, EventTypeMessageCreated))
+}
+
+// checks the user is an owner or an admin of the group
+func (s *MessageService) checkGroupModerator(ctx context.Context, user User, groupID int64) error {
+	role, err := s.groupsRepo.getGroupMemberRole(ctx, groupID, user.ID)
+	if err != nil {
+		return err
+	}
+
+	if !role.moderator() {
+		return errNotGroupAdmin
+	}
+
+	return nil
+}
+
+// checks the user can post in the group when it is in announcement mode
+func (s *MessageService) checkAnnouncement(ctx context.Context, user User, groupID int64) error {
+	settings, err := s.repo.getConversationSettings(ctx, conversationKey(conversationMessage(user, MessageTypeGroup, groupID)))
+	if err != nil {
+		return err
+	}
+
+	if !settings.Announcement {
+		return nil
+	}
+
+	err = s.checkGroupModerator(ctx, user, groupID)
+	if errors.Is(err, errNotGroupAdmin) {
+		return errAnnouncementOnly
+	}
+
+	return err
+}
+
+// turns the announcement mode of the group on or off and announces it in the conversation
+func (s *MessageService) setAnnouncement(ctx context.Context, user User, groupID int64, announcement bool) (ConversationSettings, error) {
+	if err := s.checkGroupModerator(ctx, user, groupID); err != nil {
+		return ConversationSettings{}, err
+	}
+
+	m := conversationMessage(user, MessageTypeSystem, groupID)
+
+	m.System = &SystemEvent{
+		Type:         SystemEventTypeAnnouncementChanged,
+		ActorID:      user.ID,
+		Announcement: null.BoolFrom(announcement),
+	}
+
+	return s.repo.setConversationAnnouncement(ctx, m, announcement, s.event(subjectMessagesCreated, EventTypeMessageCreated))
+}
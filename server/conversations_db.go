@@ -0,0 +1,194 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/guregu/null"
+)
+
+type ConversationSettings struct {
+	MessageTTLSeconds null.Int  `json:"message_ttl_seconds"` // messages do not expire when null
+	Announcement      bool      `json:"announcement"`        // only group owners and admins can post when true
+	UpdatedBy         null.Int  `json:"updated_by"`
+	UpdatedAt         null.Time `json:"updated_at"`
+}
+
+// returns false when the user does not exist or is not active
+func (r *MessagesRepositoryPostgreSQL) activeUserExists(ctx context.Context, id int64) (bool, error) {
+	var exists bool
+
+	err := r.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND workflow_state = 'active' AND deleted_at IS NULL)`,
+		id,
+	).Scan(&exists)
+
+	return exists, err
+}
+
+// returns default settings when the conversation has none
+func (r *MessagesRepositoryPostgreSQL) getConversationSettings(ctx context.Context, key string) (ConversationSettings, error) {
+	var cs ConversationSettings
+
+	err := r.db.QueryRowContext(ctx,
+		`SELECT message_ttl_seconds, announcement, updated_by, updated_at FROM conversation_settings WHERE conversation_key = $1`,
+		key,
+	).Scan(&cs.MessageTTLSeconds, &cs.Announcement, &cs.UpdatedBy, &cs.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ConversationSettings{}, nil
+	}
+
+	return cs, err
+}
+
+// updates the message TTL of the conversation of the system message m and inserts m with its event to the outbox
+// in a single transaction
+func (r *MessagesRepositoryPostgreSQL) setConversationMessageTTL(ctx context.Context, m Message, ttl null.Int, event messageEvent) (ConversationSettings, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ConversationSettings{}, err
+	}
+	defer tx.Rollback()
+
+	var cs ConversationSettings
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO conversation_settings (conversation_key, message_ttl_seconds, updated_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (conversation_key) DO UPDATE
+		SET message_ttl_seconds = EXCLUDED.message_ttl_seconds, updated_by = EXCLUDED.updated_by, updated_at = NOW()
+		RETURNING message_ttl_seconds, announcement, updated_by, updated_at`,
+		conversationKey(m), ttl, m.SenderID,
+	).Scan(&cs.MessageTTLSeconds, &cs.Announcement, &cs.UpdatedBy, &cs.UpdatedAt)
+	if err != nil {
+		return ConversationSettings{}, err
+	}
+
+	if _, err := r.insertMessage(ctx, tx, m, event); err != nil {
+		return ConversationSettings{}, err
+	}
+
+	return cs, tx.Commit()
+}
+
+// updates the announcement mode of the group of the system message m and inserts m with its event to the outbox
+// in a single transaction
+func (r *MessagesRepositoryPostgreSQL) setConversationAnnouncement(ctx context.Context, m Message, announcement bool, event messageEvent) (ConversationSettings, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ConversationSettings{}, err
+	}
+	defer tx.Rollback()
+
+	var cs ConversationSettings
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO conversation_settings (conversation_key, announcement, updated_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (conversation_key) DO UPDATE
+		SET announcement = EXCLUDED.announcement, updated_by = EXCLUDED.updated_by, updated_at = NOW()
+		RETURNING message_ttl_seconds, announcement, updated_by, updated_at`,
+		conversationKey(m), announcement, m.SenderID,
+	).Scan(&cs.MessageTTLSeconds, &cs.Announcement, &cs.UpdatedBy, &cs.UpdatedAt)
+	if err != nil {
+		return ConversationSettings{}, err
+	}
+
+	if _, err := r.insertMessage(ctx, tx, m, event); err != nil {
+		return ConversationSettings{}, err
+	}
+
+	return cs, tx.Commit()
+}
+
+// ExpiredMessages are the messages deleted by the reaper and the storage keys of their attachments.
+type ExpiredMessages struct {
+	Messages    []Message
+	StorageKeys []string
+}
+
+// deletes up to limit expired messages with their reactions, edits and attachments, and writes
+// their events to the outbox. References from other messages are cleared, rows are claimed with
+// SKIP LOCKED so replicas running the reaper do not block each other.
+func (r *MessagesRepositoryPostgreSQL) deleteExpiredMessages(ctx context.Context, limit int, event messageEvent) (ExpiredMessages, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ExpiredMessages{}, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT `+messageColumns+` FROM messages
+		WHERE expires_at <= NOW()
+		ORDER BY expires_at
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`,
+		limit,
+	)
+	if err != nil {
+		return ExpiredMessages{}, err
+	}
+
+	messages, err := scanMessages(rows)
+	rows.Close()
+	if err != nil || len(messages) == 0 {
+		return ExpiredMessages{}, err
+	}
+
+	ids := []int64{}
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+
+	statements := []string{
+		`UPDATE messages SET reply_to_id = NULL WHERE reply_to_id = ANY($1)`,
+		`UPDATE messages SET thread_root_id = NULL WHERE thread_root_id = ANY($1)`,
+		`UPDATE scheduled_messages SET reply_to_id = NULL WHERE reply_to_id = ANY($1)`,
+		`UPDATE scheduled_messages SET message_id = NULL WHERE message_id = ANY($1)`,
+		`DELETE FROM message_reactions WHERE message_id = ANY($1)`,
+		`DELETE FROM message_edits WHERE message_id = ANY($1)`,
+		`DELETE FROM message_pins WHERE message_id = ANY($1)`,
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement, ids); err != nil {
+			return ExpiredMessages{}, err
+		}
+	}
+
+	rows, err = tx.QueryContext(ctx, `DELETE FROM attachments WHERE message_id = ANY($1) RETURNING `+attachmentColumns, ids)
+	if err != nil {
+		return ExpiredMessages{}, err
+	}
+
+	keys := []string{}
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			rows.Close()
+			return ExpiredMessages{}, err
+		}
+
+		keys = append(keys, a.StorageKey)
+		for _, t := range a.Thumbnails {
+			keys = append(keys, t.StorageKey)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return ExpiredMessages{}, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE id = ANY($1)`, ids); err != nil {
+		return ExpiredMessages{}, err
+	}
+
+	for _, m := range messages {
+		if err := r.enqueueMessageEvent(ctx, tx, m, event); err != nil {
+			return ExpiredMessages{}, err
+		}
+	}
+
+	return ExpiredMessages{Messages: messages, StorageKeys: keys}, tx.Commit()
+}
@@ -0,0 +1,188 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/guregu/null"
+)
+
+var (
+	errDeviceNotFound = errors.New("device not found")
+	errDeviceRevoked  = errors.New("device is revoked")
+	errDeviceMismatch = errors.New("access token is bound to another device")
+	errInvalidDevice  = errors.New("device platform must be at most 32 bytes and name at most 255 bytes")
+)
+
+type Device struct {
+	ID           string    `json:"id"`
+	UserID       int64     `json:"user_id"`
+	Platform     string    `json:"platform"`
+	Name         string    `json:"name"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActiveAt time.Time `json:"last_active_at"`
+	RevokedAt    null.Time `json:"revoked_at"`
+}
+
+type DevicesRepository interface {
+	registerDevice(ctx context.Context, device Device, tokenID string) (Device, error)
+	touchDevice(ctx context.Context, id string) error
+	getDevices(ctx context.Context, userID int64) ([]Device, error)
+	revokeDevice(ctx context.Context, id string, userID int64, event func(d Device) OutboxEvent) (Device, error)
+}
+
+type DevicesRepositoryPostgreSQL struct {
+	db *sql.DB
+}
+
+func NewDevicesRepositoryPostgreSQL(db *sql.DB) *DevicesRepositoryPostgreSQL {
+	return &DevicesRepositoryPostgreSQL{
+		db: db,
+	}
+}
+
+const deviceColumns = "id, user_id, platform, name, created_at, last_active_at, revoked_at"
+
+func scanDevice(row rowScanner) (Device, error) {
+	var d Device
+
+	err := row.Scan(&d.ID, &d.UserID, &d.Platform, &d.Name, &d.CreatedAt, &d.LastActiveAt, &d.RevokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Device{}, errDeviceNotFound
+	}
+
+	return d, err
+}
+
+// creates the device when it has no id or updates its platform, name and activity. The device is bound to the
+// access token it connects with, later connections with the token use it whether they give its id or not.
+// Returns errDeviceNotFound when the device is one of another user, errDeviceMismatch when the token is bound
+// to another device and errDeviceRevoked when it is revoked.
+func (r *DevicesRepositoryPostgreSQL) registerDevice(ctx context.Context, device Device, tokenID string) (Device, error) {
+	if device.ID != "" {
+		if _, err := uuid.Parse(device.ID); err != nil {
+			return Device{}, errDeviceNotFound
+		}
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Device{}, err
+	}
+	defer tx.Rollback()
+
+	if tokenID != "" {
+		bound, err := scanDevice(tx.QueryRowContext(ctx,
+			`SELECT `+deviceColumns+` FROM devices
+			WHERE id = (SELECT device_id FROM device_tokens WHERE token_id = $1)`,
+			tokenID,
+		))
+		switch {
+		case errors.Is(err, errDeviceNotFound):
+		case err != nil:
+			return Device{}, err
+		case bound.RevokedAt.Valid:
+			return Device{}, errDeviceRevoked
+		case device.ID != "" && device.ID != bound.ID:
+			return Device{}, errDeviceMismatch
+		default:
+			device.ID = bound.ID
+		}
+	}
+
+	if device.ID == "" {
+		device.ID = uuid.NewString()
+	}
+
+	d, err := scanDevice(tx.QueryRowContext(ctx,
+		`INSERT INTO devices (id, user_id, platform, name)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE
+		SET platform = EXCLUDED.platform, name = EXCLUDED.name, last_active_at = NOW()
+		WHERE devices.user_id = EXCLUDED.user_id
+		RETURNING `+deviceColumns,
+		device.ID, device.UserID, device.Platform, device.Name,
+	))
+	if err != nil {
+		return Device{}, err
+	}
+
+	if d.RevokedAt.Valid {
+		return Device{}, errDeviceRevoked
+	}
+
+	if tokenID != "" {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO device_tokens (token_id, device_id) VALUES ($1, $2) ON CONFLICT (token_id) DO NOTHING`,
+			tokenID, d.ID,
+		)
+		if err != nil {
+			return Device{}, err
+		}
+	}
+
+	return d, tx.Commit()
+}
+
+func (r *DevicesRepositoryPostgreSQL) touchDevice(ctx context.Context, id string) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE devices SET last_active_at = NOW() WHERE id = $1`, id)
+
+	return err
+}
+
+// returns the devices of the user that are not revoked, most recently active first
+func (r *DevicesRepositoryPostgreSQL) getDevices(ctx context.Context, userID int64) ([]Device, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+deviceColumns+` FROM devices
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY last_active_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []Device{}
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, d)
+	}
+
+	return results, rows.Err()
+}
+
+// revokes the device and writes its event to the outbox in a single transaction
+func (r *DevicesRepositoryPostgreSQL) revokeDevice(ctx context.Context, id string, userID int64, event func(d Device) OutboxEvent) (Device, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return Device{}, errDeviceNotFound
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Device{}, err
+	}
+	defer tx.Rollback()
+
+	d, err := scanDevice(tx.QueryRowContext(ctx,
+		`UPDATE devices SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+		RETURNING `+deviceColumns,
+		id, userID,
+	))
+	if err != nil {
+		return Device{}, err
+	}
+
+	if err := enqueueEvents(ctx, tx, event(d)); err != nil {
+		return Device{}, err
+	}
+
+	return d, tx.Commit()
+}
@@ -0,0 +1,45 @@
+package mig
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (c *APIController) getDevices(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	results, err := c.devicesRepo.getDevices(context.Background(), u.ID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// revokes the device, its live connections are closed by the server they are connected to
+func (c *APIController) revokeDevice(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	result, err := c.devicesRepo.revokeDevice(context.Background(), chi.URLParam(r, "id"), u.ID, func(d Device) OutboxEvent {
+		return OutboxEvent{
+			Subject: subjectDevicesRevoked,
+			Event: Event{
+				Type:       EventTypeDeviceRevoked,
+				Recipients: []int64{d.UserID},
+				Device:     &d,
+			},
+		}
+	})
+	if err != nil {
+		return messageError(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
@@ -0,0 +1,520 @@
+package mig
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"mig/eventspb"
+	"time"
+
+	"github.com/guregu/null"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// version of the event schema in proto/events.proto, sent with every record
+const eventSchemaVersion = "1"
+
+// headers of records published on the message broker
+const (
+	headerEventVersion = "mig-event-version"
+	headerContentType  = "content-type"
+)
+
+const contentTypeProtobuf = "application/x-protobuf"
+
+// encodes the event with the current schema, the headers are set on the broker record
+func encodeEvent(event Event) ([]byte, map[string]string, error) {
+	data, err := proto.Marshal(eventToProto(event))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headers := map[string]string{
+		headerEventVersion: eventSchemaVersion,
+		headerContentType:  contentTypeProtobuf,
+	}
+
+	return data, headers, nil
+}
+
+// decodes an event with the schema version of its record. Records without version
+// were published before the schema, as JSON on Kafka or gob on NATS.
+func decodeEvent(version string, data []byte) (Event, error) {
+	switch version {
+	case "":
+		return decodeLegacyEvent(data)
+	case eventSchemaVersion:
+		var pb eventspb.Event
+		if err := proto.Unmarshal(data, &pb); err != nil {
+			return Event{}, err
+		}
+
+		return eventFromProto(&pb), nil
+	default:
+		return Event{}, fmt.Errorf("unsupported event schema version: %s", version)
+	}
+}
+
+// legacyMessage is the record published by the first producers: a bare message, without event envelope
+type legacyMessage struct {
+	ID          int64       `json:"id"`
+	SenderID    int64       `json:"sender_id"`
+	RecipientID int64       `json:"recipient_id"`
+	Content     string      `json:"content"`
+	MessageType MessageType `json:"message_type"`
+}
+
+// decodes an event published before the schema, records without event type are bare messages
+// wrapped in a message.created event. Their recipients are resolved on delivery, see deliverEvent.
+func decodeLegacyEvent(data []byte) (Event, error) {
+	var event Event
+	var m legacyMessage
+
+	if json.Valid(data) {
+		if err := json.Unmarshal(data, &event); err != nil {
+			return Event{}, err
+		}
+
+		if event.Type == "" {
+			if err := json.Unmarshal(data, &m); err != nil {
+				return Event{}, err
+			}
+			return legacyMessageEvent(m)
+		}
+
+		return event, nil
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&event); err != nil {
+		return Event{}, err
+	}
+
+	if event.Type == "" {
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&m); err != nil {
+			return Event{}, err
+		}
+		return legacyMessageEvent(m)
+	}
+
+	return event, nil
+}
+
+func legacyMessageEvent(m legacyMessage) (Event, error) {
+	if m.MessageType == "" {
+		return Event{}, fmt.Errorf("legacy record is neither an event nor a message")
+	}
+
+	message := Message{
+		ID:          m.ID,
+		SenderID:    m.SenderID,
+		RecipientID: m.RecipientID,
+		Content:     m.Content,
+		MessageType: m.MessageType,
+	}
+
+	return Event{
+		Type:            EventTypeMessageCreated,
+		ConversationKey: conversationKey(message),
+		Message:         &message,
+	}, nil
+}
+
+func timestampToProto(t time.Time) *timestamppb.Timestamp {
+	return timestamppb.New(t)
+}
+
+func nullTimeToProto(t null.Time) *timestamppb.Timestamp {
+	if !t.Valid {
+		return nil
+	}
+
+	return timestamppb.New(t.Time)
+}
+
+func timestampFromProto(t *timestamppb.Timestamp) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+
+	return t.AsTime()
+}
+
+func nullTimeFromProto(t *timestamppb.Timestamp) null.Time {
+	if t == nil {
+		return null.Time{}
+	}
+
+	return null.TimeFrom(t.AsTime())
+}
+
+func nullIntToProto(i null.Int) *int64 {
+	if !i.Valid {
+		return nil
+	}
+
+	return proto.Int64(i.Int64)
+}
+
+func nullIntFromProto(i *int64) null.Int {
+	if i == nil {
+		return null.Int{}
+	}
+
+	return null.IntFrom(*i)
+}
+
+func nullStringToProto(s null.String) *string {
+	if !s.Valid {
+		return nil
+	}
+
+	return proto.String(s.String)
+}
+
+func nullStringFromProto(s *string) null.String {
+	if s == nil {
+		return null.String{}
+	}
+
+	return null.StringFrom(*s)
+}
+
+func eventToProto(e Event) *eventspb.Event {
+	pb := &eventspb.Event{
+		Id:              e.ID,
+		Type:            string(e.Type),
+		ConversationKey: e.ConversationKey,
+		Recipients:      e.Recipients,
+	}
+
+	if e.Message != nil {
+		pb.Message = messageToProto(*e.Message)
+	}
+
+	if e.Reaction != nil {
+		pb.Reaction = &eventspb.Reaction{
+			MessageId: e.Reaction.MessageID,
+			UserId:    e.Reaction.UserID,
+			Emoji:     e.Reaction.Emoji,
+			CreatedAt: timestampToProto(e.Reaction.CreatedAt),
+		}
+	}
+
+	if e.Pin != nil {
+		pb.Pin = &eventspb.Pin{
+			MessageId: e.Pin.MessageID,
+			PinnedBy:  e.Pin.PinnedBy,
+			PinnedAt:  timestampToProto(e.Pin.PinnedAt),
+		}
+		if e.Pin.Message != nil {
+			pb.Pin.Message = messageToProto(*e.Pin.Message)
+		}
+	}
+
+	if e.Friendship != nil {
+		pb.Friendship = &eventspb.Friendship{
+			Id:                  e.Friendship.ID,
+			RequesterId:         e.Friendship.RequesterID,
+			UserId:              e.Friendship.UserID,
+			WorkflowState:       e.Friendship.WorkflowState,
+			WorkflowCompletedBy: e.Friendship.WorkflowCompletedBy,
+			CreatedAt:           timestampToProto(e.Friendship.CreatedAt),
+			UpdatedAt:           timestampToProto(e.Friendship.UpdatedAt),
+			DeletedAt:           nullTimeToProto(e.Friendship.DeletedAt),
+		}
+	}
+
+	if e.Error != nil {
+		pb.Error = &eventspb.Error{
+			Code:       e.Error.Code,
+			Message:    e.Error.Message,
+			RetryAfter: e.Error.RetryAfter,
+		}
+	}
+
+	if e.Receipt != nil {
+		pb.Receipt = &eventspb.Receipt{
+			MessageId: e.Receipt.MessageID,
+			UserId:    e.Receipt.UserID,
+			Status:    e.Receipt.Status,
+			CreatedAt: timestampToProto(e.Receipt.CreatedAt),
+		}
+	}
+
+	if e.Presence != nil {
+		pb.Presence = &eventspb.Presence{
+			UserId:     e.Presence.UserID,
+			Status:     e.Presence.Status,
+			LastSeenAt: nullTimeToProto(e.Presence.LastSeenAt),
+		}
+	}
+
+	if e.Session != nil {
+		pb.Session = &eventspb.Session{
+			Id:          e.Session.ID,
+			LastEventId: e.Session.LastEventID,
+		}
+	}
+
+	if e.Device != nil {
+		pb.Device = &eventspb.Device{
+			Id:           e.Device.ID,
+			UserId:       e.Device.UserID,
+			Platform:     e.Device.Platform,
+			Name:         e.Device.Name,
+			CreatedAt:    timestampToProto(e.Device.CreatedAt),
+			LastActiveAt: timestampToProto(e.Device.LastActiveAt),
+			RevokedAt:    nullTimeToProto(e.Device.RevokedAt),
+		}
+	}
+
+	return pb
+}
+
+func messageToProto(m Message) *eventspb.Message {
+	pb := &eventspb.Message{
+		Id:            m.ID,
+		Sequence:      m.Sequence,
+		SenderId:      m.SenderID,
+		RecipientId:   m.RecipientID,
+		Content:       m.Content,
+		MessageType:   string(m.MessageType),
+		ReplyToId:     nullIntToProto(m.ReplyToID),
+		ThreadRootId:  nullIntToProto(m.ThreadRootID),
+		CreatedAt:     timestampToProto(m.CreatedAt),
+		EditedAt:      nullTimeToProto(m.EditedAt),
+		DeletedAt:     nullTimeToProto(m.DeletedAt),
+		ExpiresAt:     nullTimeToProto(m.ExpiresAt),
+		AttachmentIds: m.AttachmentIDs,
+		ReplyCount:    m.ReplyCount,
+		LastReplyAt:   nullTimeToProto(m.LastReplyAt),
+
+		SenderDeviceId: nullStringToProto(m.SenderDeviceID),
+	}
+
+	if m.System != nil {
+		pb.System = &eventspb.SystemEvent{
+			Type:              string(m.System.Type),
+			ActorId:           m.System.ActorID,
+			UserId:            nullIntToProto(m.System.UserID),
+			MessageTtlSeconds: nullIntToProto(m.System.MessageTTLSeconds),
+			Name:              nullStringToProto(m.System.Name),
+			PreviousName:      nullStringToProto(m.System.PreviousName),
+		}
+		if m.System.Announcement.Valid {
+			pb.System.Announcement = proto.Bool(m.System.Announcement.Bool)
+		}
+	}
+
+	for _, a := range m.Attachments {
+		attachment := &eventspb.Attachment{
+			Id:          a.ID,
+			UploaderId:  a.UploaderID,
+			MessageId:   nullIntToProto(a.MessageID),
+			Filename:    a.Filename,
+			MimeType:    a.MimeType,
+			Size:        a.Size,
+			Checksum:    a.Checksum,
+			Width:       nullIntToProto(a.Width),
+			Height:      nullIntToProto(a.Height),
+			CreatedAt:   timestampToProto(a.CreatedAt),
+			Url:         a.URL,
+			Blurhash:    nullStringToProto(a.Blurhash),
+			ProcessedAt: nullTimeToProto(a.ProcessedAt),
+		}
+
+		for _, t := range a.Thumbnails {
+			attachment.Thumbnails = append(attachment.Thumbnails, &eventspb.Thumbnail{
+				Width:    int64(t.Width),
+				Height:   int64(t.Height),
+				MimeType: t.MimeType,
+				Size:     t.Size,
+				Url:      t.URL,
+			})
+		}
+
+		pb.Attachments = append(pb.Attachments, attachment)
+	}
+
+	for _, rc := range m.Reactions {
+		pb.Reactions = append(pb.Reactions, &eventspb.ReactionCount{
+			Emoji:   rc.Emoji,
+			Count:   rc.Count,
+			Reacted: rc.Reacted,
+		})
+	}
+
+	return pb
+}
+
+func eventFromProto(pb *eventspb.Event) Event {
+	e := Event{
+		ID:              pb.GetId(),
+		Type:            EventType(pb.GetType()),
+		ConversationKey: pb.GetConversationKey(),
+		Recipients:      pb.GetRecipients(),
+	}
+
+	if m := pb.GetMessage(); m != nil {
+		message := messageFromProto(m)
+		e.Message = &message
+	}
+
+	if r := pb.GetReaction(); r != nil {
+		e.Reaction = &Reaction{
+			MessageID: r.GetMessageId(),
+			UserID:    r.GetUserId(),
+			Emoji:     r.GetEmoji(),
+			CreatedAt: timestampFromProto(r.GetCreatedAt()),
+		}
+	}
+
+	if p := pb.GetPin(); p != nil {
+		e.Pin = &Pin{
+			MessageID: p.GetMessageId(),
+			PinnedBy:  p.GetPinnedBy(),
+			PinnedAt:  timestampFromProto(p.GetPinnedAt()),
+		}
+		if m := p.GetMessage(); m != nil {
+			message := messageFromProto(m)
+			e.Pin.Message = &message
+		}
+	}
+
+	if f := pb.GetFriendship(); f != nil {
+		e.Friendship = &Friendship{
+			ID:                  f.GetId(),
+			RequesterID:         f.GetRequesterId(),
+			UserID:              f.GetUserId(),
+			WorkflowState:       f.GetWorkflowState(),
+			WorkflowCompletedBy: f.GetWorkflowCompletedBy(),
+			CreatedAt:           timestampFromProto(f.GetCreatedAt()),
+			UpdatedAt:           timestampFromProto(f.GetUpdatedAt()),
+			DeletedAt:           nullTimeFromProto(f.GetDeletedAt()),
+		}
+	}
+
+	if er := pb.GetError(); er != nil {
+		e.Error = &ErrorResponse{
+			Code:       er.GetCode(),
+			Message:    er.GetMessage(),
+			RetryAfter: er.GetRetryAfter(),
+		}
+	}
+
+	if r := pb.GetReceipt(); r != nil {
+		e.Receipt = &Receipt{
+			MessageID: r.GetMessageId(),
+			UserID:    r.GetUserId(),
+			Status:    r.GetStatus(),
+			CreatedAt: timestampFromProto(r.GetCreatedAt()),
+		}
+	}
+
+	if p := pb.GetPresence(); p != nil {
+		e.Presence = &Presence{
+			UserID:     p.GetUserId(),
+			Status:     p.GetStatus(),
+			LastSeenAt: nullTimeFromProto(p.GetLastSeenAt()),
+		}
+	}
+
+	if s := pb.GetSession(); s != nil {
+		e.Session = &Session{
+			ID:          s.GetId(),
+			LastEventID: s.GetLastEventId(),
+		}
+	}
+
+	if d := pb.GetDevice(); d != nil {
+		e.Device = &Device{
+			ID:           d.GetId(),
+			UserID:       d.GetUserId(),
+			Platform:     d.GetPlatform(),
+			Name:         d.GetName(),
+			CreatedAt:    timestampFromProto(d.GetCreatedAt()),
+			LastActiveAt: timestampFromProto(d.GetLastActiveAt()),
+			RevokedAt:    nullTimeFromProto(d.GetRevokedAt()),
+		}
+	}
+
+	return e
+}
+
+func messageFromProto(pb *eventspb.Message) Message {
+	m := Message{
+		ID:            pb.GetId(),
+		Sequence:      pb.GetSequence(),
+		SenderID:      pb.GetSenderId(),
+		RecipientID:   pb.GetRecipientId(),
+		Content:       pb.GetContent(),
+		MessageType:   MessageType(pb.GetMessageType()),
+		ReplyToID:     nullIntFromProto(pb.ReplyToId),
+		ThreadRootID:  nullIntFromProto(pb.ThreadRootId),
+		CreatedAt:     timestampFromProto(pb.GetCreatedAt()),
+		EditedAt:      nullTimeFromProto(pb.GetEditedAt()),
+		DeletedAt:     nullTimeFromProto(pb.GetDeletedAt()),
+		ExpiresAt:     nullTimeFromProto(pb.GetExpiresAt()),
+		AttachmentIDs: pb.GetAttachmentIds(),
+		ReplyCount:    pb.GetReplyCount(),
+		LastReplyAt:   nullTimeFromProto(pb.GetLastReplyAt()),
+
+		SenderDeviceID: nullStringFromProto(pb.SenderDeviceId),
+	}
+
+	if s := pb.GetSystem(); s != nil {
+		m.System = &SystemEvent{
+			Type:              SystemEventType(s.GetType()),
+			ActorID:           s.GetActorId(),
+			UserID:            nullIntFromProto(s.UserId),
+			MessageTTLSeconds: nullIntFromProto(s.MessageTtlSeconds),
+			Name:              nullStringFromProto(s.Name),
+			PreviousName:      nullStringFromProto(s.PreviousName),
+		}
+		if s.Announcement != nil {
+			m.System.Announcement = null.BoolFrom(*s.Announcement)
+		}
+	}
+
+	for _, a := range pb.GetAttachments() {
+		attachment := Attachment{
+			ID:          a.GetId(),
+			UploaderID:  a.GetUploaderId(),
+			MessageID:   nullIntFromProto(a.MessageId),
+			Filename:    a.GetFilename(),
+			MimeType:    a.GetMimeType(),
+			Size:        a.GetSize(),
+			Checksum:    a.GetChecksum(),
+			Width:       nullIntFromProto(a.Width),
+			Height:      nullIntFromProto(a.Height),
+			CreatedAt:   timestampFromProto(a.GetCreatedAt()),
+			URL:         a.GetUrl(),
+			Blurhash:    nullStringFromProto(a.Blurhash),
+			ProcessedAt: nullTimeFromProto(a.GetProcessedAt()),
+		}
+
+		for _, t := range a.GetThumbnails() {
+			attachment.Thumbnails = append(attachment.Thumbnails, Thumbnail{
+				Width:    int(t.GetWidth()),
+				Height:   int(t.GetHeight()),
+				MimeType: t.GetMimeType(),
+				Size:     t.GetSize(),
+				URL:      t.GetUrl(),
+			})
+		}
+
+		m.Attachments = append(m.Attachments, attachment)
+	}
+
+	for _, rc := range pb.GetReactions() {
+		m.Reactions = append(m.Reactions, ReactionCount{
+			Emoji:   rc.GetEmoji(),
+			Count:   rc.GetCount(),
+			Reacted: rc.GetReacted(),
+		})
+	}
+
+	return m
+}
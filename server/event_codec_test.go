@@ -0,0 +1,119 @@
+package mig
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/guregu/null"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the tests")
+
+// records of every event schema ever published must keep decoding to the same events.
+// Inputs are frozen records of past producers, golden files hold the decoded events as JSON.
+func TestDecodeEventGolden(t *testing.T) {
+	tests := []struct {
+		file    string
+		version string
+	}{
+		{"v1_message_created.pb", eventSchemaVersion},
+		{"v1_reaction_added.pb", eventSchemaVersion},
+		{"legacy_message.json", ""},
+		{"legacy_message.gob", ""},
+		{"legacy_event.json", ""},
+		{"legacy_event.gob", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "events", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			event, err := decodeEvent(tt.version, data)
+			if err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+
+			if event.Type == "" {
+				t.Fatal("decoded event has no type")
+			}
+
+			got, err := json.MarshalIndent(event, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := filepath.Join("testdata", "events", tt.file+".golden.json")
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Errorf("decoded event does not match %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestEncodeEventRoundTrip(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	event := Event{
+		ID:              7,
+		Type:            EventTypeMessageUpdated,
+		ConversationKey: "group:9",
+		Recipients:      []int64{1, 2, 3},
+		Message: &Message{
+			ID:          42,
+			Sequence:    3,
+			SenderID:    1,
+			RecipientID: 9,
+			Content:     "edited",
+			MessageType: MessageTypeGroup,
+			CreatedAt:   created,
+			EditedAt:    null.TimeFrom(created.Add(time.Minute)),
+		},
+	}
+
+	data, headers, err := encodeEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodeEvent(headers[headerEventVersion], data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := json.Marshal(event)
+	got, _ := json.Marshal(decoded)
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("round trip changed the event\ngot:  %s\nwant: %s", got, want)
+	}
+}
+
+func TestDecodeLegacyEventRejectsUnknownRecords(t *testing.T) {
+	if _, err := decodeEvent("", []byte(`{"id":1}`)); err == nil {
+		t.Error("expected an error for a record without type nor message type")
+	}
+
+	if _, err := decodeEvent("2", nil); err == nil {
+		t.Error("expected an error for an unsupported schema version")
+	}
+}
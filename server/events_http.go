@@ -0,0 +1,332 @@
+package mig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/guregu/null"
+	"github.com/rs/zerolog/log"
+)
+
+// HTTP fallbacks of websocket delivery for clients behind proxies blocking websockets.
+// Their clients are registered on the hub like websocket clients without connection.
+
+const (
+	sseRetry           = 3 * time.Second  // reconnection delay suggested to EventSource clients
+	sseHeartbeat       = 15 * time.Second // comment written to keep idle streams open through proxies
+	longPollTimeout    = 25 * time.Second // default wait for an event
+	longPollMaxTimeout = time.Minute
+)
+
+var errStreamingUnsupported = errors.New("streaming is not supported")
+
+// LongPollResponse holds the events received since the id of the request. Clients poll again
+// from LastEventID, they fetch the history of their conversations when Resync is true.
+type LongPollResponse struct {
+	Events      []Event `json:"events"`
+	LastEventID int64   `json:"last_event_id"`
+	Resync      bool    `json:"resync"`
+}
+
+// parses the id of the last event received by the client from the Last-Event-ID header or the given query param
+func lastEventID(r *http.Request, param string) (null.Int, error) {
+	s := r.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = r.URL.Query().Get(param)
+	}
+	if s == "" {
+		return null.Int{}, nil
+	}
+
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 0 {
+		return null.Int{}, fmt.Errorf("invalid last event id: %s", s)
+	}
+
+	return null.IntFrom(id), nil
+}
+
+// registers a client without connection, unregister is called by the handler once it returns
+func (h *Hub) registerHTTPClient(user User) (*Client, bool) {
+	client := h.newClient(user, nil)
+	if !h.register(client) {
+		return nil, false
+	}
+
+	return client, true
+}
+
+func (h *Hub) unregisterHTTPClient(client *Client) {
+	h.unregister(client)
+	wsQueuedEvents.Add(-int64(len(client.message)))
+	h.writers.Done()
+}
+
+// streams events as Server-Sent Events. EventSource clients reconnecting with Last-Event-ID, or
+// last_event_id, get the events they missed before live events.
+func (h *Hub) ServeEvents(user User, w http.ResponseWriter, r *http.Request) (int, error) {
+	if h.draining.Load() {
+		return http.StatusServiceUnavailable, errServerShuttingDown
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return http.StatusInternalServerError, errStreamingUnsupported
+	}
+
+	since, err := lastEventID(r, "last_event_id")
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	// live events are queued during the replay
+	client, ok := h.registerHTTPClient(user)
+	if !ok {
+		return http.StatusServiceUnavailable, errServerShuttingDown
+	}
+	defer h.unregisterHTTPClient(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+
+	if since.Valid {
+		events, ok, err := h.missedEvents(r.Context(), user.ID, since.Int64)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("replay events: %s", err.Error()))
+			return 0, nil
+		}
+
+		if !ok {
+			events = []Event{{Type: EventTypeResync}}
+		}
+
+		for _, event := range events {
+			if err := writeServerSentEvent(w, event); err != nil {
+				return 0, nil
+			}
+			client.replayed = max(client.replayed, event.ID)
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return 0, nil
+
+		// EventSource clients reconnect on their own, to another server on shutdown
+		case <-client.done:
+			for client.flush.Load() && len(client.message) > 0 {
+				event := <-client.message
+				wsQueuedEvents.Add(-1)
+
+				if client.fresh(event) {
+					writeServerSentEvent(w, event)
+				}
+			}
+			flusher.Flush()
+			return 0, nil
+
+		case event := <-client.message:
+			wsQueuedEvents.Add(-1)
+
+			if !client.fresh(event) {
+				continue
+			}
+
+			if err := writeServerSentEvent(w, event); err != nil {
+				return 0, nil
+			}
+			flusher.Flush()
+
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return 0, nil
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writes the event as JSON data, with the id of the event in the outbox when it has one
+func writeServerSentEvent(w io.Writer, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if event.ID != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", event.ID); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+
+	return err
+}
+
+// query params
+//   - since : id of the last event received, Last-Event-ID is used when missing (optional, defaults to the latest event)
+//   - timeout : wait for an event, e.g. 25s (optional, at most 1m)
+//
+// returns the events missed since the id right away, or waits for the next live events
+func (h *Hub) PollEvents(user User, w http.ResponseWriter, r *http.Request) (int, error) {
+	if h.draining.Load() {
+		return http.StatusServiceUnavailable, errServerShuttingDown
+	}
+
+	since, err := lastEventID(r, "since")
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	timeout := longPollTimeout
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		timeout, err = time.ParseDuration(s)
+		if err != nil || timeout <= 0 || timeout > longPollMaxTimeout {
+			return http.StatusBadRequest, fmt.Errorf("invalid timeout: %s", s)
+		}
+	}
+
+	// live events are queued while missed events are read
+	client, ok := h.registerHTTPClient(user)
+	if !ok {
+		return http.StatusServiceUnavailable, errServerShuttingDown
+	}
+	defer h.unregisterHTTPClient(client)
+
+	response := LongPollResponse{
+		Events: []Event{},
+	}
+
+	if since.Valid {
+		response.LastEventID = since.Int64
+
+		events, ok, err := h.missedEvents(r.Context(), user.ID, since.Int64)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		response.Resync = !ok
+		response.Events = append(response.Events, events...)
+	} else {
+		response.LastEventID, err = h.sessions.getLatestEventID(r.Context())
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	for _, event := range response.Events {
+		client.replayed = max(client.replayed, event.ID)
+	}
+
+	if len(response.Events) == 0 && !response.Resync {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-r.Context().Done():
+			return 0, nil
+		case <-client.done:
+		case <-timer.C:
+		case event := <-client.message:
+			wsQueuedEvents.Add(-1)
+
+			if client.fresh(event) {
+				response.Events = append(response.Events, event)
+			}
+		}
+	}
+
+	// events queued with the first one are returned together
+	for len(client.message) > 0 {
+		event := <-client.message
+		wsQueuedEvents.Add(-1)
+
+		if client.fresh(event) {
+			response.Events = append(response.Events, event)
+		}
+	}
+
+	for _, event := range response.Events {
+		response.LastEventID = max(response.LastEventID, event.ID)
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// handles an event of a client that cannot use websockets, the payload is the JSON of a websocket frame.
+// Returns the message or reaction changed, clients receive its event on their stream.
+func (h *Hub) PostEvent(user User, w http.ResponseWriter, r *http.Request) (int, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid request body")
+	}
+
+	event, err := decodeClientEvent(websocket.TextMessage, data)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid request body")
+	}
+
+	// shares the budget of the user with their websocket connections
+	limits := h.rateLimits
+	if limit := limits.user(event.Type.rateClass()); limit.enabled() && limits.Store != nil {
+		key := fmt.Sprintf("ws:%s:user:%d", event.Type.rateClass(), user.ID)
+
+		result, err := limits.Store.take(r.Context(), key, limit)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("rate limit %s: %s", key, err.Error()))
+		} else if !result.Allowed {
+			wsRateLimited.Add(string(event.Type.rateClass()), 1)
+
+			retryAfter := seconds(result.RetryAfter)
+			w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Code:       fmt.Sprintf("%d", http.StatusTooManyRequests),
+				Message:    fmt.Sprintf("too many %s, retry later", event.Type.rateClass()),
+				RetryAfter: retryAfter,
+			})
+
+			return http.StatusTooManyRequests, nil
+		}
+	}
+
+	result, err := h.handle(context.Background(), user, event)
+	if err != nil {
+		return messageError(err)
+	}
+
+	code := http.StatusOK
+	if event.Type == ClientEventTypeMessageSend {
+		code = http.StatusCreated
+	}
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return code, nil
+}
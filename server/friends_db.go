@@ -4,10 +4,23 @@ import (
 	"context"
 	"database/sql"
 	"mig/models"
+	"time"
 
+	"github.com/guregu/null"
 	"github.com/volatiletech/sqlboiler/v4/queries/qm"
 )
 
+type Friendship struct {
+	ID                  int64     `json:"id"`
+	RequesterID         int64     `json:"requester_id"`
+	UserID              int64     `json:"user_id"`
+	WorkflowState       string    `json:"workflow_state"`
+	WorkflowCompletedBy int64     `json:"workflow_completed_by"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+	DeletedAt           null.Time `json:"deleted_at"`
+}
+
 func getFriendsByWorkflowState(ctx context.Context, db *sql.DB, pagination Pagination, userID int64, state models.FriendshipsWorkflowState) ([]*models.User, error) {
 	// avoid OR in INNER JOIN
 	firstResults, err := models.Users(
@@ -3,6 +3,7 @@ package mig
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"mig/models"
 	"time"
 
@@ -21,8 +22,23 @@ type Group struct {
 	DeletedAt     null.Time `json:"deleted_at"`
 }
 
+type GroupRole string
+
+const (
+	GroupRoleOwner  GroupRole = "owner"
+	GroupRoleAdmin  GroupRole = "admin"
+	GroupRoleMember GroupRole = "member"
+)
+
+// owners and admins moderate the group
+func (r GroupRole) moderator() bool {
+	return r == GroupRoleOwner || r == GroupRoleAdmin
+}
+
 type GroupsRepository interface {
 	getGroupsByWorflowStatesAndUserID(ctx context.Context, pagination Pagination, states []string, userID int64) ([]Group, error)
+	getGroupMemberIDs(ctx context.Context, groupID int64) ([]int64, error)
+	getGroupMemberRole(ctx context.Context, groupID int64, userID int64) (GroupRole, error)
 }
 
 type GroupsRepositoryPostgreSQL struct {
@@ -67,3 +83,42 @@ func (r *GroupsRepositoryPostgreSQL) getGroupsByWorflowStatesAndUserID(ctx conte
 
 	return results, err
 }
+
+// returns ids of users with an active membership of the group
+func (r *GroupsRepositoryPostgreSQL) getGroupMemberIDs(ctx context.Context, groupID int64) ([]int64, error) {
+	groupUsers, err := models.GroupUsers(
+		qm.Select(models.GroupUserColumns.UserID),
+		models.GroupUserWhere.GroupID.EQ(groupID),
+		models.GroupUserWhere.WorkflowState.EQ(models.GroupUsersWorkflowStateActive),
+	).All(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []int64{}
+
+	for _, gu := range groupUsers {
+		results = append(results, gu.UserID)
+	}
+
+	return results, nil
+}
+
+// returns the role of the user in the group, the creator of the group is its owner.
+// The role is empty when the user is not an active member.
+func (r *GroupsRepositoryPostgreSQL) getGroupMemberRole(ctx context.Context, groupID int64, userID int64) (GroupRole, error) {
+	var role sql.NullString
+
+	err := r.db.QueryRowContext(ctx,
+		`SELECT CASE WHEN g.created_by = $2 THEN 'owner' ELSE gu.role::TEXT END
+		FROM groups g
+		LEFT JOIN group_users gu ON gu.group_id = g.id AND gu.user_id = $2 AND gu.workflow_state = 'active'
+		WHERE g.id = $1`,
+		groupID, userID,
+	).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+
+	return GroupRole(role.String), err
+}
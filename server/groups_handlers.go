@@ -52,7 +52,7 @@ func groupsDTO(groups []Group) []GroupDTO {
 func (c *APIController) getGroups(w http.ResponseWriter, r *http.Request, pagination Pagination) (int, error) {
 	userID, err := strconv.ParseInt(chi.URLParam(r, "user_id"), 10, 64)
 	if err != nil {
-		return http.StatusBadRequest, fmt.Errorf("invalid or missing user_id params: %s")
+		return http.StatusBadRequest, fmt.Errorf("invalid or missing user_id params: %s", err)
 	}
 
 	states := r.URL.Query()["state[]"]
@@ -0,0 +1,127 @@
+package mig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// route groups of HTTP rate limits, routes of the strict group also count against the default group
+const (
+	RateLimitGroupDefault = "default" // every route of the API
+	RateLimitGroupStrict  = "strict"  // writes that are expensive or abused, e.g. uploads, search and friend requests
+)
+
+// RateLimitGroup is the limit of a route group per client IP and per authenticated user.
+type RateLimitGroup struct {
+	IP   RateLimit
+	User RateLimit
+}
+
+// HTTPRateLimiter limits requests per route group. Limits of users are checked once the request is authenticated.
+type HTTPRateLimiter struct {
+	store  RateLimitStore
+	groups map[string]RateLimitGroup
+}
+
+func NewHTTPRateLimiter(store RateLimitStore, groups map[string]RateLimitGroup) *HTTPRateLimiter {
+	return &HTTPRateLimiter{
+		store:  store,
+		groups: groups,
+	}
+}
+
+type rateLimitGroupsKey struct{}
+
+// returns a middleware limiting requests of the group per IP, the group is kept in the request context
+// for the limit per user
+func (l *HTTPRateLimiter) limit(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			groups, _ := r.Context().Value(rateLimitGroupsKey{}).([]string)
+			groups = append(groups[:len(groups):len(groups)], group)
+			r = r.WithContext(context.WithValue(r.Context(), rateLimitGroupsKey{}, groups))
+
+			if !l.allow(w, r, fmt.Sprintf("http:%s:ip:%s", group, clientIP(r)), l.groups[group].IP) {
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// returns false when the user exceeds the limit of a group of the request, the response is written
+func (l *HTTPRateLimiter) allowUser(w http.ResponseWriter, r *http.Request, user User) bool {
+	groups, _ := r.Context().Value(rateLimitGroupsKey{}).([]string)
+
+	for _, group := range groups {
+		if !l.allow(w, r, fmt.Sprintf("http:%s:user:%d", group, user.ID), l.groups[group].User) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// takes a token of the key and writes the RateLimit headers of the most restrictive limit of the request.
+// Requests are allowed when the store fails.
+func (l *HTTPRateLimiter) allow(w http.ResponseWriter, r *http.Request, key string, limit RateLimit) bool {
+	if !limit.enabled() {
+		return true
+	}
+
+	result, err := l.store.take(r.Context(), key, limit)
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("rate limit %s: %s", key, err.Error()))
+		return true
+	}
+
+	header := w.Header()
+	if remaining, err := strconv.Atoi(header.Get("RateLimit-Remaining")); err != nil || result.Remaining <= remaining {
+		header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		header.Set("RateLimit-Reset", strconv.FormatInt(seconds(result.Reset), 10))
+	}
+
+	if result.Allowed {
+		return true
+	}
+
+	retryAfter := seconds(result.RetryAfter)
+	header.Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	header.Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Code:       fmt.Sprintf("%d", http.StatusTooManyRequests),
+		Message:    "too many requests, retry later",
+		RetryAfter: retryAfter,
+	})
+
+	return false
+}
+
+// rounds up to whole seconds, as used by the RateLimit-Reset and Retry-After headers
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// returns the IP of the client, set from the forwarding headers of trusted proxies by the realIP middleware
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,145 @@
+package mig
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/guregu/null"
+	"github.com/rs/zerolog/log"
+)
+
+// ImageProcessor generates thumbnails and blurhash placeholders of image attachments
+// with a bounded pool of workers, so uploads return before the processing is done.
+type ImageProcessor struct {
+	attachments *AttachmentService
+	messages    *MessageService
+	workers     int
+	jobs        chan Attachment
+}
+
+func NewImageProcessor(attachments *AttachmentService, messages *MessageService, workers, queueSize int) *ImageProcessor {
+	return &ImageProcessor{
+		attachments: attachments,
+		messages:    messages,
+		workers:     workers,
+		jobs:        make(chan Attachment, queueSize),
+	}
+}
+
+// runs the workers until the context is done, returns once they finished the attachments being processed
+func (p *ImageProcessor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case attachment := <-p.jobs:
+					if err := p.process(context.WithoutCancel(ctx), attachment); err != nil {
+						msg := fmt.Sprintf("process attachment %d: %s", attachment.ID, err.Error())
+						log.Error().Msg(msg)
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// queues image attachments, attachments are left unprocessed when the queue is full
+func (p *ImageProcessor) enqueue(attachment Attachment) {
+	if !strings.HasPrefix(attachment.MimeType, "image/") {
+		return
+	}
+
+	select {
+	case p.jobs <- attachment:
+	default:
+		msg := fmt.Sprintf("image processing queue is full, attachment %d is not processed", attachment.ID)
+		log.Warn().Msg(msg)
+	}
+}
+
+func (p *ImageProcessor) process(ctx context.Context, attachment Attachment) error {
+	content, err := p.attachments.storage.get(ctx, attachment.StorageKey)
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(content)
+	content.Close()
+	if err != nil {
+		return err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return errImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	hash, err := imageBlurhash(img)
+	if err != nil {
+		return err
+	}
+
+	thumbnails := []Thumbnail{}
+	bounds := img.Bounds()
+
+	for _, size := range thumbnailSizes {
+		if bounds.Dx() <= size && bounds.Dy() <= size {
+			break
+		}
+
+		thumbnail := resizeImage(img, size)
+
+		encoded, mimeType, err := encodeThumbnail(thumbnail, attachment.MimeType)
+		if err != nil {
+			return err
+		}
+
+		t := Thumbnail{
+			Width:      thumbnail.Bounds().Dx(),
+			Height:     thumbnail.Bounds().Dy(),
+			MimeType:   mimeType,
+			Size:       int64(len(encoded)),
+			StorageKey: fmt.Sprintf("%s_%d", attachment.StorageKey, size),
+		}
+
+		if err := p.attachments.storage.put(ctx, t.StorageKey, bytes.NewReader(encoded), t.Size, t.MimeType); err != nil {
+			return err
+		}
+
+		thumbnails = append(thumbnails, t)
+	}
+
+	messageID, err := p.attachments.repo.saveAttachmentProcessing(ctx, attachment.ID, null.StringFrom(hash), thumbnails)
+	if err != nil {
+		return err
+	}
+
+	if messageID.Valid {
+		return p.messages.attachmentsProcessed(ctx, messageID.Int64)
+	}
+
+	return nil
+}
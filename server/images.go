@@ -0,0 +1,218 @@
+package mig
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"slices"
+
+	"github.com/buckket/go-blurhash"
+	"golang.org/x/image/draw"
+)
+
+const (
+	thumbnailJPEGQuality = 80
+	blurhashSize         = 32 // pixels of the longest side of the image the blurhash is computed from
+	blurhashXComponents  = 4
+	blurhashYComponents  = 3
+
+	// pixels of the images decoded to generate thumbnails, an RGBA image of this size takes 160MB.
+	// The dimensions are checked before decoding so images declaring huge dimensions cannot exhaust the memory.
+	maxImagePixels = 40_000_000
+
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// widths of the thumbnails generated for image attachments, longest side in pixels
+var thumbnailSizes = []int{160, 320, 640}
+
+// removes the metadata, which may hold the GPS location of the camera, of JPEG, PNG and WebP images.
+// Other types are returned unchanged, images that are not well formed are rejected.
+func stripMetadata(data []byte, mimeType string) ([]byte, error) {
+	switch mimeType {
+	case "image/jpeg":
+		return stripJPEGMetadata(data)
+	case "image/png":
+		return stripPNGMetadata(data)
+	case "image/webp":
+		return stripWebPMetadata(data)
+	default:
+		return data, nil
+	}
+}
+
+// removes EXIF segments
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errInvalidImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	for i := 2; i < len(data); {
+		if data[i] != 0xFF || i+1 >= len(data) {
+			return nil, errInvalidImage
+		}
+
+		marker := data[i+1]
+
+		// markers without payload
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8) {
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		}
+
+		// start of scan, the remaining entropy coded data holds no metadata
+		if marker == 0xDA || marker == 0xD9 {
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		}
+
+		if i+4 > len(data) {
+			return nil, errInvalidImage
+		}
+
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:i+4]))
+		if end > len(data) {
+			return nil, errInvalidImage
+		}
+
+		if marker == 0xE1 && bytes.HasPrefix(data[i+4:end], []byte("Exif\x00\x00")) {
+			i = end
+			continue
+		}
+
+		out.Write(data[i:end])
+		i = end
+	}
+
+	return out.Bytes(), nil
+}
+
+// PNG chunks of metadata, iTXt holds XMP packets
+var pngMetadataChunks = []string{"eXIf", "tEXt", "zTXt", "iTXt", "tIME"}
+
+// removes EXIF and text chunks
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	signature := []byte("\x89PNG\r\n\x1a\n")
+	if !bytes.HasPrefix(data, signature) {
+		return nil, errInvalidImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(signature)
+
+	// chunks are length, type, data and CRC
+	for i := len(signature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, errInvalidImage
+		}
+
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) || end < i {
+			return nil, errInvalidImage
+		}
+
+		chunk := string(data[i+4 : i+8])
+		if !slices.Contains(pngMetadataChunks, chunk) {
+			out.Write(data[i:end])
+		}
+		i = end
+
+		if chunk == "IEND" {
+			return out.Bytes(), nil
+		}
+	}
+
+	return nil, errInvalidImage
+}
+
+// removes EXIF and XMP chunks and their flags of the extended header
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errInvalidImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	// chunks are FourCC, little endian size and data padded to an even size
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errInvalidImage
+		}
+
+		size := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		end := i + 8 + size + size%2
+		if size < 0 || end > len(data) || end < i {
+			return nil, errInvalidImage
+		}
+
+		switch string(data[i : i+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			if size < 1 {
+				return nil, errInvalidImage
+			}
+
+			chunk := slices.Clone(data[i:end])
+			chunk[8] &^= webpFlagEXIF | webpFlagXMP
+			out.Write(chunk)
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+
+	return stripped, nil
+}
+
+// scales the image down so its longest side is size pixels, smaller images are returned unchanged
+func resizeImage(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width <= size && height <= size {
+		return src
+	}
+
+	if width >= height {
+		height = max(1, height*size/width)
+		width = size
+	} else {
+		width = max(1, width*size/height)
+		height = size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	return dst
+}
+
+// encodes thumbnails as JPEG, or PNG when the original may have transparency
+func encodeThumbnail(img image.Image, mimeType string) ([]byte, string, error) {
+	var buf bytes.Buffer
+
+	if mimeType == "image/jpeg" {
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailJPEGQuality})
+		return buf.Bytes(), "image/jpeg", err
+	}
+
+	err := png.Encode(&buf, img)
+
+	return buf.Bytes(), "image/png", err
+}
+
+func imageBlurhash(img image.Image) (string, error) {
+	return blurhash.Encode(blurhashXComponents, blurhashYComponents, resizeImage(img, blurhashSize))
+}
@@ -2,11 +2,13 @@ package mig
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/IBM/sarama"
+	"github.com/guregu/null"
 	"github.com/rs/zerolog/log"
 )
 
@@ -15,26 +17,46 @@ type MessageType string
 const (
 	MessageTypePrivate MessageType = "private"
 	MessageTypeGroup   MessageType = "group"
+	MessageTypeSystem  MessageType = "system" // server generated messages of group conversations
 )
 
 type Message struct {
-	ID          int64       `json:"id"`
-	SenderID    int64       `json:"sender_id"`
-	RecipientID int64       `json:"recipient_id"` // user id or group id
-	Content     string      `json:"content"`
-	MessageType MessageType `json:"message_type"`
+	ID           int64        `json:"id"`
+	Sequence     int64        `json:"sequence"` // monotonic per conversation, clients detect missed messages from gaps
+	SenderID     int64        `json:"sender_id"`
+	RecipientID  int64        `json:"recipient_id"` // user id or group id
+	Content      string       `json:"content"`
+	MessageType  MessageType  `json:"message_type"`
+	ReplyToID    null.Int     `json:"reply_to_id"`    // quoted message of the same conversation
+	ThreadRootID null.Int     `json:"thread_root_id"` // set by the server from reply_to_id
+	CreatedAt    time.Time    `json:"created_at"`
+	EditedAt     null.Time    `json:"edited_at"`
+	DeletedAt    null.Time    `json:"deleted_at"` // deleted messages are kept as tombstones without content
+	ExpiresAt    null.Time    `json:"expires_at"`
+	System       *SystemEvent `json:"system,omitempty"` // set on server generated messages only
+
+	SenderDeviceID null.String `json:"sender_device_id"` // device the message was sent from
+
+	AttachmentIDs []int64      `json:"attachment_ids,omitempty"` // uploaded attachments to send with the message
+	Attachments   []Attachment `json:"attachments,omitempty"`
+
+	Reactions   []ReactionCount `json:"reactions,omitempty"`
+	ReplyCount  int64           `json:"reply_count,omitempty"`
+	LastReplyAt null.Time       `json:"last_reply_at"`
 }
 
+// Kafka publishes every event on a single topic keyed by conversation, so the events of a conversation
+// share a partition and are consumed in the order they were published, whatever their type.
 type Kafka struct {
 	producer sarama.SyncProducer
 	consumer sarama.ConsumerGroup
-	topics   []string
+	topic    string
 }
 
-func NewKafka(brokers []string, version sarama.KafkaVersion, topics []string, assignor, group string) (*Kafka, error) {
+func NewKafka(brokers []string, version sarama.KafkaVersion, topic, assignor, group string) (*Kafka, error) {
 	config := sarama.NewConfig()
 	config.Version = version
-	config.Producer.Partitioner = sarama.NewRandomPartitioner
+	config.Producer.Partitioner = sarama.NewHashPartitioner
 	config.Producer.Retry.Max = 10
 	config.Producer.RequiredAcks = sarama.WaitForAll
 	config.Producer.Return.Successes = true
@@ -63,34 +85,49 @@ func NewKafka(brokers []string, version sarama.KafkaVersion, topics []string, as
 	kafka := &Kafka{
 		producer: producer,
 		consumer: consumer,
-		topics:   topics,
+		topic:    topic,
 	}
 
 	return kafka, nil
 }
 
+// leaves the consumer group once the claims in progress are processed and committed, then closes the producer
 func (k *Kafka) Close() error {
-	return k.consumer.Close()
+	if err := k.consumer.Close(); err != nil {
+		return err
+	}
+
+	return k.producer.Close()
 }
 
-func (k *Kafka) SendMessage(m Message, topic string) error {
-	payload, err := json.Marshal(m)
+// the subject is only used by brokers routing events by subject, events are published on the topic of the broker
+func (k *Kafka) publish(subject string, event Event) error {
+	payload, headers, err := encodeEvent(event)
 	if err != nil {
 		return err
 	}
 
+	// events of a conversation share a partition so consumers receive them in order
 	msg := &sarama.ProducerMessage{
-		Topic: topic,
-		Value: sarama.StringEncoder(payload),
+		Topic: k.topic,
+		Value: sarama.ByteEncoder(payload),
+	}
+	for key, value := range headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+	if event.ConversationKey != "" {
+		msg.Key = sarama.StringEncoder(event.ConversationKey)
 	}
 	_, _, err = k.producer.SendMessage(msg)
 
 	return err
 }
 
+// consumes the topic until the context is done or the consumer group is closed, returns once the records
+// being delivered are marked
 func (k *Kafka) Consume(ctx context.Context, c *Consumer) {
-	for {
-		if err := k.consumer.Consume(ctx, k.topics, c); err != nil {
+	for ctx.Err() == nil {
+		if err := k.consumer.Consume(ctx, []string{k.topic}, c); err != nil {
 			if errors.Is(err, sarama.ErrClosedConsumerGroup) {
 				return
 			}
@@ -101,21 +138,35 @@ func (k *Kafka) Consume(ctx context.Context, c *Consumer) {
 
 // Reference - https://github.com/IBM/sarama/blob/main/examples/consumergroup/main.go
 
-// Consumer represents a Sarama consumer group consumer
+// Consumer represents a Sarama consumer group consumer.
+// Records that cannot be decoded or delivered are sent to the dead-letter queue before their offset is marked.
 type Consumer struct {
-	Ready chan bool
-	hub   *Hub
+	Ready       chan bool // closed once the consumer joined the group
+	ready       sync.Once
+	hub         *Hub
+	dlq         *DeadLetterQueue
+	maxAttempts int           // deliveries of a record before it is dead-lettered
+	backoff     time.Duration // wait after the first failed delivery, doubled after each attempt
 }
 
-func NewConsumer(hub *Hub) *Consumer {
+// longest wait between attempts to produce on the dead-letter queue
+const maxDLQBackoff = 30 * time.Second
+
+func NewConsumer(hub *Hub, dlq *DeadLetterQueue, maxAttempts int, backoff time.Duration) *Consumer {
 	return &Consumer{
-		Ready: make(chan bool),
-		hub:   hub,
+		Ready:       make(chan bool),
+		hub:         hub,
+		dlq:         dlq,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
 	}
 }
 
+// called on every rebalance
 func (consumer *Consumer) Setup(sarama.ConsumerGroupSession) error {
-	close(consumer.Ready)
+	consumer.ready.Do(func() {
+		close(consumer.Ready)
+	})
 
 	return nil
 }
@@ -133,14 +184,9 @@ func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 				return nil
 			}
 
-			var payload Message
-			if err := json.Unmarshal(msg.Value, &payload); err != nil {
-				log.Error().Msg(err.Error())
-				break
-			}
-
-			for _, client := range consumer.hub.clients[payload.RecipientID] {
-				client.message <- payload
+			// the offset is left unmarked when the session ends, the record is consumed again
+			if err := consumer.process(session.Context(), msg); err != nil {
+				return nil
 			}
 
 			session.MarkMessage(msg, "")
@@ -149,3 +195,68 @@ func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 		}
 	}
 }
+
+// delivers the record or quarantines it on the dead-letter queue, only fails when the context is done
+func (consumer *Consumer) process(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	reason, attempts, err := consumer.handle(ctx, msg)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	log.Error().Msg(fmt.Sprintf("dead-letter record %s/%d/%d after %d attempts: %s", msg.Topic, msg.Partition, msg.Offset, attempts, err))
+
+	for backoff := consumer.backoff; ; backoff = min(backoff*2, maxDLQBackoff) {
+		dlqErr := consumer.dlq.send(msg, reason, attempts, err)
+		if dlqErr == nil {
+			return nil
+		}
+
+		log.Error().Msg(fmt.Sprintf("send record %s/%d/%d to dead-letter queue: %s", msg.Topic, msg.Partition, msg.Offset, dlqErr))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// decodes and delivers the record, retrying failed deliveries with backoff.
+// Returns the reason it failed for and the number of attempts.
+func (consumer *Consumer) handle(ctx context.Context, msg *sarama.ConsumerMessage) (string, int, error) {
+	var version string
+	for _, h := range msg.Headers {
+		if string(h.Key) == headerEventVersion {
+			version = string(h.Value)
+		}
+	}
+
+	event, err := decodeEvent(version, msg.Value)
+	if err != nil {
+		return dlqReasonMalformed, 1, fmt.Errorf("%w: %w", errPoisonRecord, err)
+	}
+
+	if event.Type == "" {
+		return dlqReasonInvalid, 1, fmt.Errorf("%w: missing event type", errPoisonRecord)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := deliverEvent(consumer.hub, event)
+		if err == nil {
+			return "", attempt, nil
+		}
+
+		if attempt >= consumer.maxAttempts {
+			return dlqReasonDelivery, attempt, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", attempt, ctx.Err()
+		case <-time.After(consumer.backoff << (attempt - 1)):
+		}
+	}
+}
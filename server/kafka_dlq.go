@@ -0,0 +1,267 @@
+package mig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// headers set on dead-lettered records, replay reads the original topic from them
+const (
+	headerDLQError             = "x-mig-error"
+	headerDLQReason            = "x-mig-reason"
+	headerDLQOriginalTopic     = "x-mig-original-topic"
+	headerDLQOriginalPartition = "x-mig-original-partition"
+	headerDLQOriginalOffset    = "x-mig-original-offset"
+	headerDLQAttempts          = "x-mig-attempts"
+	headerDLQFailedAt          = "x-mig-failed-at"
+)
+
+// reasons records are dead-lettered for
+const (
+	dlqReasonMalformed = "malformed"
+	dlqReasonInvalid   = "invalid"
+	dlqReasonDelivery  = "delivery"
+)
+
+// records dead-lettered by reason, served with the other expvar metrics on the metrics listener
+var dlqRecords = expvar.NewMap("mig_kafka_dlq_records")
+
+// errPoisonRecord marks records that fail the same way on every attempt, they are dead-lettered without retries
+var errPoisonRecord = errors.New("poison record")
+
+// DeadLetterQueue quarantines records the consumer cannot process on a separate topic.
+type DeadLetterQueue struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func (k *Kafka) DeadLetterQueue(topic string) *DeadLetterQueue {
+	return &DeadLetterQueue{
+		producer: k.producer,
+		topic:    topic,
+	}
+}
+
+// produces the record on the dead-letter topic with its error as headers
+func (q *DeadLetterQueue) send(msg *sarama.ConsumerMessage, reason string, attempts int, cause error) error {
+	headers := []sarama.RecordHeader{}
+	for _, h := range msg.Headers {
+		headers = append(headers, *h)
+	}
+
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(headerDLQError), Value: []byte(cause.Error())},
+		sarama.RecordHeader{Key: []byte(headerDLQReason), Value: []byte(reason)},
+		sarama.RecordHeader{Key: []byte(headerDLQOriginalTopic), Value: []byte(msg.Topic)},
+		sarama.RecordHeader{Key: []byte(headerDLQOriginalPartition), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		sarama.RecordHeader{Key: []byte(headerDLQOriginalOffset), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		sarama.RecordHeader{Key: []byte(headerDLQAttempts), Value: []byte(strconv.Itoa(attempts))},
+		sarama.RecordHeader{Key: []byte(headerDLQFailedAt), Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	)
+
+	_, _, err := q.producer.SendMessage(&sarama.ProducerMessage{
+		Topic:   q.topic,
+		Key:     sarama.ByteEncoder(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	})
+	if err != nil {
+		return err
+	}
+
+	dlqRecords.Add(reason, 1)
+
+	return nil
+}
+
+// DeadLetterRecord is a dead-lettered record as printed by the dlq inspect command.
+type DeadLetterRecord struct {
+	Partition int32             `json:"partition"`
+	Offset    int64             `json:"offset"`
+	Key       string            `json:"key,omitempty"`
+	Headers   map[string]string `json:"headers"`
+	Value     string            `json:"value"`
+}
+
+func deadLetterRecord(msg *sarama.ConsumerMessage) DeadLetterRecord {
+	record := DeadLetterRecord{
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       string(msg.Key),
+		Headers:   map[string]string{},
+		Value:     string(msg.Value),
+	}
+
+	for _, h := range msg.Headers {
+		record.Headers[string(h.Key)] = string(h.Value)
+	}
+
+	return record
+}
+
+// DeadLetterReader reads the records of a dead-letter topic without committing offsets.
+type DeadLetterReader struct {
+	client   sarama.Client
+	consumer sarama.Consumer
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func NewDeadLetterReader(brokers []string, version sarama.KafkaVersion, topic string) (*DeadLetterReader, error) {
+	config := sarama.NewConfig()
+	config.Version = version
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		consumer.Close()
+		client.Close()
+		return nil, err
+	}
+
+	return &DeadLetterReader{
+		client:   client,
+		consumer: consumer,
+		producer: producer,
+		topic:    topic,
+	}, nil
+}
+
+func (r *DeadLetterReader) Close() error {
+	r.producer.Close()
+	r.consumer.Close()
+
+	return r.client.Close()
+}
+
+// calls fn with the records of the partition, or of every partition when partition is negative,
+// from offset up to the records present when called. Reads at most limit records when positive.
+func (r *DeadLetterReader) read(ctx context.Context, partition int32, offset int64, limit int, fn func(msg *sarama.ConsumerMessage) error) error {
+	partitions := []int32{partition}
+	if partition < 0 {
+		var err error
+		if partitions, err = r.consumer.Partitions(r.topic); err != nil {
+			return err
+		}
+	}
+
+	read := 0
+
+	for _, p := range partitions {
+		newest, err := r.client.GetOffset(r.topic, p, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+
+		oldest, err := r.client.GetOffset(r.topic, p, sarama.OffsetOldest)
+		if err != nil {
+			return err
+		}
+
+		start := max(offset, oldest)
+		if start >= newest {
+			continue
+		}
+
+		pc, err := r.consumer.ConsumePartition(r.topic, p, start)
+		if err != nil {
+			return err
+		}
+
+		for done := false; !done; {
+			select {
+			case msg := <-pc.Messages():
+				if err := fn(msg); err != nil {
+					pc.Close()
+					return err
+				}
+
+				read++
+				done = msg.Offset+1 >= newest || (limit > 0 && read >= limit)
+			case <-ctx.Done():
+				pc.Close()
+				return ctx.Err()
+			}
+		}
+
+		if err := pc.Close(); err != nil {
+			return err
+		}
+
+		if limit > 0 && read >= limit {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// writes the records as JSON lines
+func (r *DeadLetterReader) Inspect(ctx context.Context, w io.Writer, partition int32, offset int64, limit int) error {
+	encoder := json.NewEncoder(w)
+
+	return r.read(ctx, partition, offset, limit, func(msg *sarama.ConsumerMessage) error {
+		return encoder.Encode(deadLetterRecord(msg))
+	})
+}
+
+// produces the records again on their original topic, or on topic when set,
+// without the dead-letter headers. Returns the number of records replayed.
+func (r *DeadLetterReader) Replay(ctx context.Context, topic string, partition int32, offset int64, limit int) (int, error) {
+	replayed := 0
+
+	err := r.read(ctx, partition, offset, limit, func(msg *sarama.ConsumerMessage) error {
+		record := &sarama.ProducerMessage{
+			Topic: topic,
+			Key:   sarama.ByteEncoder(msg.Key),
+			Value: sarama.ByteEncoder(msg.Value),
+		}
+
+		for _, h := range msg.Headers {
+			switch string(h.Key) {
+			case headerDLQOriginalTopic:
+				if topic == "" {
+					record.Topic = string(h.Value)
+				}
+			case headerDLQError, headerDLQReason, headerDLQOriginalPartition, headerDLQOriginalOffset, headerDLQAttempts, headerDLQFailedAt:
+			default:
+				record.Headers = append(record.Headers, *h)
+			}
+		}
+
+		if record.Topic == "" {
+			return fmt.Errorf("record %d/%d has no original topic", msg.Partition, msg.Offset)
+		}
+
+		if _, _, err := r.producer.SendMessage(record); err != nil {
+			return err
+		}
+
+		replayed++
+
+		return nil
+	})
+
+	return replayed, err
+}
@@ -1,5 +1,85 @@
 package mig
 
+import (
+	"time"
+
+	"github.com/guregu/null"
+)
+
 type MessageBroker interface {
-	publish(topic string, message Message) error
+	publish(topic string, event Event) error
+}
+
+type EventType string
+
+const (
+	EventTypeMessageCreated    EventType = "message.created"
+	EventTypeMessageUpdated    EventType = "message.updated"
+	EventTypeMessageDeleted    EventType = "message.deleted"
+	EventTypeMessageExpired    EventType = "message.expired"
+	EventTypeReactionAdded     EventType = "reaction.added"
+	EventTypeReactionRemoved   EventType = "reaction.removed"
+	EventTypeMessagePinned     EventType = "message.pinned"
+	EventTypeMessageUnpinned   EventType = "message.unpinned"
+	EventTypeFriendshipUpdated EventType = "friendship.updated"
+	EventTypeReceiptUpdated    EventType = "receipt.updated"
+	EventTypePresenceUpdated   EventType = "presence.updated"
+	EventTypeDeviceRevoked     EventType = "device.revoked" // connections of the device are closed
+	EventTypeTyping            EventType = "typing"
+	EventTypeSession           EventType = "session"      // first event written to clients, with the session to resume on reconnect
+	EventTypeResync            EventType = "resync"       // written to clients that missed events, they fetch the history of their conversations
+	EventTypeRateLimited       EventType = "rate_limited" // written to clients sending events faster than their limit
+	EventTypeError             EventType = "error"
+)
+
+// ephemeral events are only useful to connected clients, brokers storing events may skip storing them
+func (t EventType) ephemeral() bool {
+	return t == EventTypeTyping || t == EventTypePresenceUpdated
+}
+
+// subjects used to publish events on the message broker
+const (
+	subjectMessagesCreated         = "mig.messages.created"
+	subjectMessagesUpdated         = "mig.messages.updated"
+	subjectMessagesDeleted         = "mig.messages.deleted"
+	subjectMessagesExpired         = "mig.messages.expired"
+	subjectMessagesReactionAdded   = "mig.messages.reaction_added"
+	subjectMessagesReactionRemoved = "mig.messages.reaction_removed"
+	subjectMessagesPinned          = "mig.messages.pinned"
+	subjectMessagesUnpinned        = "mig.messages.unpinned"
+	subjectFriendshipsUpdated      = "mig.friendships.updated" // published by a database trigger
+	subjectDevicesRevoked          = "mig.devices.revoked"
+)
+
+// Event is the envelope published on the message broker and written to websocket connections.
+// Recipients are the user ids the event is delivered to, they are not sent to clients.
+type Event struct {
+	ID              int64          `json:"id,omitempty"` // number of the event in the outbox assigned when it is published, clients resume their session from it
+	Type            EventType      `json:"type"`
+	ConversationKey string         `json:"conversation_key,omitempty"` // partitioning key of brokers ordering events by conversation
+	Recipients      []int64        `json:"recipients,omitempty"`
+	Message         *Message       `json:"message,omitempty"`
+	Reaction        *Reaction      `json:"reaction,omitempty"`
+	Pin             *Pin           `json:"pin,omitempty"`
+	Friendship      *Friendship    `json:"friendship,omitempty"`
+	Receipt         *Receipt       `json:"receipt,omitempty"`
+	Presence        *Presence      `json:"presence,omitempty"`
+	Device          *Device        `json:"device,omitempty"`
+	Error           *ErrorResponse `json:"error,omitempty"`
+	Session         *Session       `json:"session,omitempty"` // written to clients only, never published
+}
+
+// Receipt tells the sender a recipient received or read the message.
+type Receipt struct {
+	MessageID int64     `json:"message_id"`
+	UserID    int64     `json:"user_id"`
+	Status    string    `json:"status"` // delivered or read
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Presence tells friends and group members whether the user is connected.
+type Presence struct {
+	UserID     int64     `json:"user_id"`
+	Status     string    `json:"status"` // online or offline
+	LastSeenAt null.Time `json:"last_seen_at"`
 }
@@ -0,0 +1,488 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+	"unicode/utf8"
+
+	"github.com/guregu/null"
+)
+
+const maxEmojiLength = 32 // bytes, matches message_reactions.emoji
+
+var (
+	errNotMessageSender      = errors.New("only the sender can change the message")
+	errEditWindowExpired     = errors.New("message can no longer be changed")
+	errMessageDeleted        = errors.New("message is deleted")
+	errInvalidMessageType    = errors.New("invalid message_type")
+	errEmptyContent          = errors.New("content must not be empty")
+	errUnrecognizedEventType = errors.New("unrecognized event type")
+	errNotParticipant        = errors.New("user is not part of the conversation")
+	errInvalidEmoji          = errors.New("invalid emoji")
+	errInvalidReplyTo        = errors.New("reply_to_id must reference a message of the same conversation")
+	errNotGroupAdmin         = errors.New("only group owners and admins can do this")
+	errAnnouncementOnly      = errors.New("only group owners and admins can post in announcement mode")
+)
+
+// maps errors returned while handling messages to HTTP status codes
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errMessageNotFound), errors.Is(err, errConversationNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errNotMessageSender), errors.Is(err, errEditWindowExpired), errors.Is(err, errNotParticipant):
+		return http.StatusForbidden
+	case errors.Is(err, errNotGroupAdmin), errors.Is(err, errAnnouncementOnly):
+		return http.StatusForbidden
+	case errors.Is(err, errMessageDeleted):
+		return http.StatusGone
+	case errors.Is(err, errInvalidMessageType), errors.Is(err, errEmptyContent), errors.Is(err, errUnrecognizedEventType), errors.Is(err, errInvalidEmoji), errors.Is(err, errInvalidReplyTo):
+		return http.StatusBadRequest
+	case errors.Is(err, errAttachmentNotFound), errors.Is(err, errBlobNotFound), errors.Is(err, errThumbnailNotFound), errors.Is(err, errScheduledMessageNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errInvalidAttachments), errors.Is(err, errMissingAttachmentName), errors.Is(err, errInvalidSendAt), errors.Is(err, errInvalidMessageTTL):
+		return http.StatusBadRequest
+	case errors.Is(err, errDeviceNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errDeviceRevoked), errors.Is(err, errDeviceMismatch):
+		return http.StatusForbidden
+	case errors.Is(err, errInvalidDevice):
+		return http.StatusBadRequest
+	case errors.Is(err, errPinLimitReached):
+		return http.StatusConflict
+	case errors.Is(err, errInvalidImage):
+		return http.StatusBadRequest
+	case errors.Is(err, errAttachmentTooLarge), errors.Is(err, errImageTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errQuotaExceeded), errors.Is(err, errInvalidSignature):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// MessageService persists messages and writes their events to the outbox, see OutboxRelay.
+// It is shared by the websocket clients and the REST handlers.
+type MessageService struct {
+	repo        MessagesRepository
+	groupsRepo  GroupsRepository
+	attachments *AttachmentService
+	editWindow  time.Duration // time after creation during which the sender can edit or delete a message
+	pinLimit    int           // maximum number of pinned messages per conversation
+}
+
+func NewMessageService(repo MessagesRepository, groupsRepo GroupsRepository, attachments *AttachmentService, editWindow time.Duration, pinLimit int) *MessageService {
+	return &MessageService{
+		repo:        repo,
+		groupsRepo:  groupsRepo,
+		attachments: attachments,
+		editWindow:  editWindow,
+		pinLimit:    pinLimit,
+	}
+}
+
+func (s *MessageService) send(ctx context.Context, sender User, m Message) (Message, error) {
+	m, err := s.prepare(ctx, sender, m)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return s.create(ctx, m)
+}
+
+// sends the message in the transaction of the caller, see Scheduler
+func (s *MessageService) sendTx(ctx context.Context, tx *sql.Tx, sender User, m Message) (Message, error) {
+	m, err := s.prepare(ctx, sender, m)
+	if err != nil {
+		return Message{}, err
+	}
+
+	message, err := s.repo.insertMessage(ctx, tx, m, s.event(subjectMessagesCreated, EventTypeMessageCreated))
+	if err != nil {
+		return Message{}, err
+	}
+
+	return s.withURLs(message), nil
+}
+
+// validates the message of the sender and resolves its thread
+func (s *MessageService) prepare(ctx context.Context, sender User, m Message) (Message, error) {
+	if m.MessageType != MessageTypePrivate && m.MessageType != MessageTypeGroup {
+		return Message{}, errInvalidMessageType
+	}
+
+	if m.Content == "" && len(m.AttachmentIDs) == 0 {
+		return Message{}, errEmptyContent
+	}
+
+	m.SenderID = sender.ID
+	m.SenderDeviceID = null.NewString(sender.DeviceID, sender.DeviceID != "")
+	m.ThreadRootID = null.Int{}
+	m.System = nil
+
+	// scheduled messages are checked again when sent, the sender may have left the group since
+	if err := s.checkParticipant(ctx, sender, m.MessageType, m.RecipientID); err != nil {
+		return Message{}, err
+	}
+
+	if m.MessageType == MessageTypeGroup {
+		if err := s.checkAnnouncement(ctx, sender, m.RecipientID); err != nil {
+			return Message{}, err
+		}
+	}
+
+	if m.ReplyToID.Valid {
+		replyTo, err := s.repo.getMessageByID(ctx, m.ReplyToID.Int64)
+		if errors.Is(err, errMessageNotFound) {
+			return Message{}, errInvalidReplyTo
+		}
+		if err != nil {
+			return Message{}, err
+		}
+
+		if !sameConversation(m, replyTo) {
+			return Message{}, errInvalidReplyTo
+		}
+
+		m.ThreadRootID = null.IntFrom(replyTo.ID)
+		if replyTo.ThreadRootID.Valid {
+			m.ThreadRootID = replyTo.ThreadRootID
+		}
+	}
+
+	return m, nil
+}
+
+// persists the message and publishes it to the recipients
+func (s *MessageService) create(ctx context.Context, m Message) (Message, error) {
+	message, err := s.repo.createMessage(ctx, m, s.event(subjectMessagesCreated, EventTypeMessageCreated))
+	if err != nil {
+		return Message{}, err
+	}
+
+	return s.withURLs(message), nil
+}
+
+func (s *MessageService) edit(ctx context.Context, user User, messageID int64, content string) (Message, error) {
+	if content == "" {
+		return Message{}, errEmptyContent
+	}
+
+	if _, err := s.changeable(ctx, user, messageID); err != nil {
+		return Message{}, err
+	}
+
+	return s.repo.updateMessageContent(ctx, messageID, content, user.ID, s.event(subjectMessagesUpdated, EventTypeMessageUpdated))
+}
+
+func (s *MessageService) delete(ctx context.Context, user User, messageID int64) (Message, error) {
+	if _, err := s.changeable(ctx, user, messageID); err != nil {
+		return Message{}, err
+	}
+
+	return s.repo.deleteMessage(ctx, messageID, s.event(subjectMessagesDeleted, EventTypeMessageDeleted))
+}
+
+// checks the user is the sender and the message is still within the edit window
+func (s *MessageService) changeable(ctx context.Context, user User, messageID int64) (Message, error) {
+	message, err := s.repo.getMessageByID(ctx, messageID)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if message.DeletedAt.Valid {
+		return Message{}, errMessageDeleted
+	}
+
+	if message.SenderID != user.ID || message.System != nil {
+		return Message{}, errNotMessageSender
+	}
+
+	if time.Since(message.CreatedAt) > s.editWindow {
+		return Message{}, errEditWindowExpired
+	}
+
+	return message, nil
+}
+
+// returns messages of the conversation with their reaction counts, kind is private or group
+// and conversationID the other user id or the group id
+func (s *MessageService) history(ctx context.Context, user User, kind MessageType, conversationID int64, pagination Pagination, afterSequence null.Int) ([]Message, error) {
+	if err := s.checkParticipant(ctx, user, kind, conversationID); err != nil {
+		return nil, err
+	}
+
+	messages, err := s.repo.getConversationMessages(ctx, pagination, user.ID, kind, conversationID, afterSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int64{}
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+
+	counts, err := s.repo.getReactionCounts(ctx, ids, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	threads, err := s.repo.getThreadSummaries(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.withAttachments(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	for i := range messages {
+		messages[i].Reactions = counts[messages[i].ID]
+
+		if thread, ok := threads[messages[i].ID]; ok {
+			messages[i].ReplyCount = thread.ReplyCount
+			messages[i].LastReplyAt = null.TimeFrom(thread.LastReplyAt)
+		}
+	}
+
+	return messages, nil
+}
+
+// sets the attachments of the messages with signed download URLs
+func (s *MessageService) withAttachments(ctx context.Context, messages []Message) error {
+	ids := []int64{}
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+
+	attachments, err := s.attachments.repo.getAttachmentsByMessageIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		for _, a := range attachments[messages[i].ID] {
+			messages[i].Attachments = append(messages[i].Attachments, s.attachments.withURL(a))
+		}
+	}
+
+	return nil
+}
+
+// returns a copy of the message with signed download URLs of its attachments
+func (s *MessageService) withURLs(m Message) Message {
+	attachments := []Attachment{}
+	for _, a := range m.Attachments {
+		attachments = append(attachments, s.attachments.withURL(a))
+	}
+
+	if len(attachments) > 0 {
+		m.Attachments = attachments
+	}
+
+	return m
+}
+
+// notifies the recipients of the message that its attachments changed, e.g. when thumbnails are ready
+func (s *MessageService) attachmentsProcessed(ctx context.Context, messageID int64) error {
+	message, err := s.repo.getMessageByID(ctx, messageID)
+	if err != nil {
+		return err
+	}
+
+	if message.DeletedAt.Valid {
+		return nil
+	}
+
+	messages := []Message{message}
+	if err := s.withAttachments(ctx, messages); err != nil {
+		return err
+	}
+
+	return s.publish(ctx, subjectMessagesUpdated, EventTypeMessageUpdated, messages[0])
+}
+
+// returns the attachment with a signed download URL, the user must be the uploader
+// or part of the conversation of the message the attachment was sent with
+func (s *MessageService) attachment(ctx context.Context, user User, id int64) (Attachment, error) {
+	attachment, err := s.attachments.repo.getAttachmentByID(ctx, id)
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	if attachment.UploaderID != user.ID {
+		if !attachment.MessageID.Valid {
+			return Attachment{}, errAttachmentNotFound
+		}
+
+		message, err := s.repo.getMessageByID(ctx, attachment.MessageID.Int64)
+		if err != nil {
+			return Attachment{}, err
+		}
+
+		recipients, err := s.recipients(ctx, message)
+		if err != nil {
+			return Attachment{}, err
+		}
+
+		if !slices.Contains(recipients, user.ID) {
+			return Attachment{}, errAttachmentNotFound
+		}
+	}
+
+	return s.attachments.withURL(attachment), nil
+}
+
+// returns replies to the thread root message, the user must be part of its conversation
+func (s *MessageService) thread(ctx context.Context, user User, rootID int64, pagination Pagination) ([]Message, error) {
+	root, err := s.repo.getMessageByID(ctx, rootID)
+	if err != nil {
+		return nil, err
+	}
+
+	recipients, err := s.recipients(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(recipients, user.ID) {
+		return nil, errNotParticipant
+	}
+
+	return s.repo.getThreadMessages(ctx, pagination, root.ID)
+}
+
+// reports whether both messages belong to the same private pair or group
+func sameConversation(a, b Message) bool {
+	if a.MessageType != b.MessageType {
+		return false
+	}
+
+	switch a.MessageType {
+	case MessageTypePrivate:
+		return (a.SenderID == b.SenderID && a.RecipientID == b.RecipientID) ||
+			(a.SenderID == b.RecipientID && a.RecipientID == b.SenderID)
+	case MessageTypeGroup:
+		return a.RecipientID == b.RecipientID
+	default:
+		return false
+	}
+}
+
+func (s *MessageService) addReaction(ctx context.Context, user User, messageID int64, emoji string) (Reaction, error) {
+	return s.react(ctx, user, messageID, emoji, true)
+}
+
+func (s *MessageService) removeReaction(ctx context.Context, user User, messageID int64, emoji string) (Reaction, error) {
+	return s.react(ctx, user, messageID, emoji, false)
+}
+
+// adds or removes the reaction, events are only published when the reactions changed
+func (s *MessageService) react(ctx context.Context, user User, messageID int64, emoji string, add bool) (Reaction, error) {
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) {
+		return Reaction{}, errInvalidEmoji
+	}
+
+	message, err := s.repo.getMessageByID(ctx, messageID)
+	if err != nil {
+		return Reaction{}, err
+	}
+
+	if message.DeletedAt.Valid {
+		return Reaction{}, errMessageDeleted
+	}
+
+	recipients, err := s.recipients(ctx, message)
+	if err != nil {
+		return Reaction{}, err
+	}
+
+	if !slices.Contains(recipients, user.ID) {
+		return Reaction{}, errNotParticipant
+	}
+
+	reaction := Reaction{
+		MessageID: messageID,
+		UserID:    user.ID,
+		Emoji:     emoji,
+		CreatedAt: time.Now(),
+	}
+
+	subject, eventType, change := subjectMessagesReactionAdded, EventTypeReactionAdded, s.repo.addReaction
+	if !add {
+		subject, eventType, change = subjectMessagesReactionRemoved, EventTypeReactionRemoved, s.repo.removeReaction
+	}
+
+	_, err = change(ctx, reaction, OutboxEvent{
+		Subject: subject,
+		Event: Event{
+			Type:            eventType,
+			ConversationKey: conversationKey(message),
+			Recipients:      recipients,
+			Reaction:        &reaction,
+		},
+	})
+
+	return reaction, err
+}
+
+// returns the user ids taking part in the conversation of the message,
+// users leaving a group receive the system message announcing it
+func (s *MessageService) recipients(ctx context.Context, m Message) ([]int64, error) {
+	switch m.MessageType {
+	case MessageTypePrivate:
+		return []int64{m.SenderID, m.RecipientID}, nil
+	case MessageTypeGroup:
+		return s.groupsRepo.getGroupMemberIDs(ctx, m.RecipientID)
+	case MessageTypeSystem:
+		members, err := s.groupsRepo.getGroupMemberIDs(ctx, m.RecipientID)
+		if err != nil {
+			return nil, err
+		}
+
+		if m.System != nil && m.System.UserID.Valid && !slices.Contains(members, m.System.UserID.Int64) {
+			members = append(members, m.System.UserID.Int64)
+		}
+
+		return members, nil
+	default:
+		return nil, errInvalidMessageType
+	}
+}
+
+// returns the outbox event of a change to the message, sent to the recipients of its conversation
+func (s *MessageService) event(subject string, eventType EventType) messageEvent {
+	return func(m Message) (OutboxEvent, error) {
+		recipients, err := s.recipients(context.Background(), m)
+		if err != nil {
+			return OutboxEvent{}, fmt.Errorf("recipients: %w", err)
+		}
+
+		m = s.withURLs(m)
+
+		return OutboxEvent{
+			Subject: subject,
+			Event: Event{
+				Type:            eventType,
+				ConversationKey: conversationKey(m),
+				Recipients:      recipients,
+				Message:         &m,
+			},
+		}, nil
+	}
+}
+
+// writes the event of the message to the outbox outside of a transaction, for changes
+// that can be published again, e.g. processed attachments
+func (s *MessageService) publish(ctx context.Context, subject string, eventType EventType, m Message) error {
+	event, err := s.event(subject, eventType)(m)
+	if err != nil {
+		return err
+	}
+
+	return s.repo.enqueueEvents(ctx, event)
+}
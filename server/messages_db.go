@@ -0,0 +1,350 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/guregu/null"
+)
+
+var errMessageNotFound = errors.New("message not found")
+
+type MessageEdit struct {
+	ID        int64     `json:"id"`
+	MessageID int64     `json:"message_id"`
+	Content   string    `json:"content"`
+	EditedBy  int64     `json:"edited_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type MessagesRepository interface {
+	createMessage(ctx context.Context, m Message, event messageEvent) (Message, error)
+	insertMessage(ctx context.Context, tx *sql.Tx, m Message, event messageEvent) (Message, error)
+	getMessageByID(ctx context.Context, id int64) (Message, error)
+	updateMessageContent(ctx context.Context, id int64, content string, editedBy int64, event messageEvent) (Message, error)
+	deleteMessage(ctx context.Context, id int64, event messageEvent) (Message, error)
+	getMessageEdits(ctx context.Context, messageID int64) ([]MessageEdit, error)
+	getConversationMessages(ctx context.Context, pagination Pagination, userID int64, kind MessageType, conversationID int64, afterSequence null.Int) ([]Message, error)
+	addReaction(ctx context.Context, reaction Reaction, event OutboxEvent) (bool, error)
+	removeReaction(ctx context.Context, reaction Reaction, event OutboxEvent) (bool, error)
+	getReactionCounts(ctx context.Context, messageIDs []int64, userID int64) (map[int64][]ReactionCount, error)
+	getThreadMessages(ctx context.Context, pagination Pagination, rootID int64) ([]Message, error)
+	getThreadSummaries(ctx context.Context, rootIDs []int64) (map[int64]ThreadSummary, error)
+	searchMessages(ctx context.Context, userID int64, search MessageSearch) ([]MessageSearchResult, error)
+	activeUserExists(ctx context.Context, id int64) (bool, error)
+	getConversationSettings(ctx context.Context, key string) (ConversationSettings, error)
+	setConversationMessageTTL(ctx context.Context, m Message, ttl null.Int, event messageEvent) (ConversationSettings, error)
+	setConversationAnnouncement(ctx context.Context, m Message, announcement bool, event messageEvent) (ConversationSettings, error)
+	deleteExpiredMessages(ctx context.Context, limit int, event messageEvent) (ExpiredMessages, error)
+	pinMessage(ctx context.Context, pin Pin, key string, limit int, event func(p Pin) OutboxEvent) (Pin, bool, error)
+	unpinMessage(ctx context.Context, messageID int64, event OutboxEvent) (bool, error)
+	getConversationPins(ctx context.Context, key string) ([]Pin, error)
+	enqueueEvents(ctx context.Context, events ...OutboxEvent) error
+}
+
+type MessagesRepositoryPostgreSQL struct {
+	db *sql.DB
+}
+
+func NewMessagesRepositoryPostgreSQL(db *sql.DB) *MessagesRepositoryPostgreSQL {
+	return &MessagesRepositoryPostgreSQL{
+		db: db,
+	}
+}
+
+const messageColumns = "id, sequence, sender_id, recipient_id, message_type, content, reply_to_id, thread_root_id, created_at, edited_at, deleted_at, expires_at, system, sender_device_id"
+
+// expired messages are hidden until the reaper deletes them
+const notExpired = "(expires_at IS NULL OR expires_at > NOW())"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scans messageColumns followed by the extra columns selected
+func scanMessage(row rowScanner, extra ...any) (Message, error) {
+	var m Message
+	var editedAt, deletedAt sql.NullTime
+	var system []byte
+
+	dest := []any{&m.ID, &m.Sequence, &m.SenderID, &m.RecipientID, &m.MessageType, &m.Content, &m.ReplyToID, &m.ThreadRootID, &m.CreatedAt, &editedAt, &deletedAt, &m.ExpiresAt, &system, &m.SenderDeviceID}
+
+	err := row.Scan(append(dest, extra...)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, errMessageNotFound
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	m.EditedAt = null.NewTime(editedAt.Time, editedAt.Valid)
+	m.DeletedAt = null.NewTime(deletedAt.Time, deletedAt.Valid)
+
+	if system != nil {
+		if err := json.Unmarshal(system, &m.System); err != nil {
+			return Message{}, err
+		}
+	}
+
+	return m, nil
+}
+
+// inserts the message, links its attachments and writes its event to the outbox in a single transaction
+func (r *MessagesRepositoryPostgreSQL) createMessage(ctx context.Context, m Message, event messageEvent) (Message, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+
+	message, err := r.insertMessage(ctx, tx, m, event)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return message, tx.Commit()
+}
+
+// inserts the message, links its attachments and writes its event to the outbox in the transaction of the caller
+func (r *MessagesRepositoryPostgreSQL) insertMessage(ctx context.Context, tx *sql.Tx, m Message, event messageEvent) (Message, error) {
+	// server generated messages do not expire
+	var system, ttlKey any
+	if m.System != nil {
+		data, err := json.Marshal(m.System)
+		if err != nil {
+			return Message{}, err
+		}
+		system = string(data)
+	} else {
+		ttlKey = conversationKey(m)
+	}
+
+	row := tx.QueryRowContext(ctx,
+		`INSERT INTO messages (sender_id, recipient_id, message_type, content, reply_to_id, thread_root_id, system, expires_at, sequence, sender_device_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7,
+			NOW() + make_interval(secs => (SELECT message_ttl_seconds FROM conversation_settings WHERE conversation_key = $8)),
+			next_conversation_sequence($9),
+			$10
+		)
+		RETURNING `+messageColumns,
+		m.SenderID, m.RecipientID, m.MessageType, m.Content, m.ReplyToID, m.ThreadRootID, system, ttlKey, conversationKey(m), m.SenderDeviceID,
+	)
+
+	message, err := scanMessage(row)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if len(m.AttachmentIDs) > 0 {
+		rows, err := tx.QueryContext(ctx,
+			`UPDATE attachments SET message_id = $1
+			WHERE id = ANY($2) AND uploader_id = $3 AND message_id IS NULL AND deleted_at IS NULL
+			RETURNING `+attachmentColumns,
+			message.ID, m.AttachmentIDs, m.SenderID,
+		)
+		if err != nil {
+			return Message{}, err
+		}
+
+		for rows.Next() {
+			a, err := scanAttachment(rows)
+			if err != nil {
+				rows.Close()
+				return Message{}, err
+			}
+			message.Attachments = append(message.Attachments, a)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return Message{}, err
+		}
+
+		if len(message.Attachments) != len(m.AttachmentIDs) {
+			return Message{}, errInvalidAttachments
+		}
+
+		message.AttachmentIDs = m.AttachmentIDs
+	}
+
+	if err := r.enqueueMessageEvent(ctx, tx, message, event); err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+func (r *MessagesRepositoryPostgreSQL) getMessageByID(ctx context.Context, id int64) (Message, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE id = $1 AND `+notExpired, id)
+
+	return scanMessage(row)
+}
+
+// keeps the previous content in message_edits, updates the message and writes its event to the outbox in a single transaction
+func (r *MessagesRepositoryPostgreSQL) updateMessageContent(ctx context.Context, id int64, content string, editedBy int64, event messageEvent) (Message, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO message_edits (message_id, content, edited_by)
+		SELECT id, content, $2 FROM messages WHERE id = $1 AND deleted_at IS NULL`,
+		id, editedBy,
+	)
+	if err != nil {
+		return Message{}, err
+	}
+
+	row := tx.QueryRowContext(ctx,
+		`UPDATE messages SET content = $2, edited_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING `+messageColumns,
+		id, content,
+	)
+
+	m, err := scanMessage(row)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if err := r.enqueueMessageEvent(ctx, tx, m, event); err != nil {
+		return Message{}, err
+	}
+
+	return m, tx.Commit()
+}
+
+// soft deletes the message and its attachments leaving a tombstone without content, the message is unpinned
+// and the event of the unpin is written with the event of the deletion
+func (r *MessagesRepositoryPostgreSQL) deleteMessage(ctx context.Context, id int64, event messageEvent) (Message, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx,
+		`WITH deleted_attachments AS (
+			UPDATE attachments SET deleted_at = NOW() WHERE message_id = $1 AND deleted_at IS NULL
+		)
+		UPDATE messages SET content = '', deleted_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING `+messageColumns,
+		id,
+	)
+
+	m, err := scanMessage(row)
+	if err != nil {
+		return Message{}, err
+	}
+
+	e, err := event(m)
+	if err != nil {
+		return Message{}, err
+	}
+
+	events := []OutboxEvent{e}
+
+	pin := Pin{MessageID: m.ID}
+	err = tx.QueryRowContext(ctx,
+		`DELETE FROM message_pins WHERE message_id = $1 RETURNING pinned_by, created_at`,
+		id,
+	).Scan(&pin.PinnedBy, &pin.PinnedAt)
+	if err == nil {
+		events = append(events, unpinnedEvent(pin, e))
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return Message{}, err
+	}
+
+	if err := enqueueEvents(ctx, tx, events...); err != nil {
+		return Message{}, err
+	}
+
+	return m, tx.Commit()
+}
+
+func (r *MessagesRepositoryPostgreSQL) getMessageEdits(ctx context.Context, messageID int64) ([]MessageEdit, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT id, message_id, content, edited_by, created_at FROM message_edits
+		WHERE message_id = $1
+		ORDER BY created_at`,
+		messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []MessageEdit{}
+
+	for rows.Next() {
+		var e MessageEdit
+		if err := rows.Scan(&e.ID, &e.MessageID, &e.Content, &e.EditedBy, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, e)
+	}
+
+	return results, rows.Err()
+}
+
+// returns messages of a private conversation between the user and conversationID,
+// or of the group conversationID, newest first. When afterSequence is set the messages
+// following it are returned oldest first, for clients filling a gap.
+func (r *MessagesRepositoryPostgreSQL) getConversationMessages(ctx context.Context, pagination Pagination, userID int64, kind MessageType, conversationID int64, afterSequence null.Int) ([]Message, error) {
+	var conversation string
+	args := []any{}
+
+	switch kind {
+	case MessageTypePrivate:
+		conversation = `message_type = 'private' AND ((sender_id = $1 AND recipient_id = $2) OR (sender_id = $2 AND recipient_id = $1))`
+		args = append(args, userID, conversationID)
+	case MessageTypeGroup:
+		conversation = `message_type IN ('group', 'system') AND recipient_id = $1`
+		args = append(args, conversationID)
+	default:
+		return nil, errInvalidMessageType
+	}
+
+	order := "id DESC"
+	if afterSequence.Valid {
+		args = append(args, afterSequence.Int64)
+		conversation += fmt.Sprintf(" AND sequence > $%d", len(args))
+		order = "sequence"
+	}
+
+	args = append(args, pagination.pageSize, pagination.page)
+
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+messageColumns+` FROM messages
+		WHERE `+conversation+` AND `+notExpired+`
+		ORDER BY `+order+`
+		LIMIT `+fmt.Sprintf("$%d OFFSET $%d", len(args)-1, len(args)),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMessages(rows)
+}
+
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	results := []Message{}
+
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, m)
+	}
+
+	return results, rows.Err()
+}
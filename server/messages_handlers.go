@@ -0,0 +1,294 @@
+package mig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/guregu/null"
+)
+
+type EditMessageRequest struct {
+	Content string `json:"content"`
+}
+
+// returns the status code of errors raised by the message service
+func messageError(err error) (int, error) {
+	return errorStatus(err), err
+}
+
+func (c *APIController) editMessage(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid message id")
+	}
+
+	var req EditMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid request body")
+	}
+
+	message, err := c.messages.edit(context.Background(), u, id, req.Content)
+	if err != nil {
+		return messageError(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(message); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+func (c *APIController) deleteMessage(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid message id")
+	}
+
+	message, err := c.messages.delete(context.Background(), u, id)
+	if err != nil {
+		return messageError(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(message); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// only the sender can read the edit history of a message
+func (c *APIController) getMessageEdits(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid message id")
+	}
+
+	message, err := c.messagesRepo.getMessageByID(context.Background(), id)
+	if err != nil {
+		return messageError(err)
+	}
+
+	if message.SenderID != u.ID {
+		return http.StatusForbidden, fmt.Errorf("only the sender can read the edit history")
+	}
+
+	results, err := c.messagesRepo.getMessageEdits(context.Background(), id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// kind: private or group, id: the other user id or the group id
+func parseConversation(r *http.Request) (MessageType, int64, error) {
+	kind := MessageType(chi.URLParam(r, "kind"))
+	if kind != MessageTypePrivate && kind != MessageTypeGroup {
+		return "", 0, fmt.Errorf("invalid conversation kind")
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid conversation id")
+	}
+
+	return kind, id, nil
+}
+
+func (c *APIController) getConversationMessages(u User, w http.ResponseWriter, r *http.Request, pagination Pagination) (int, error) {
+	kind, id, err := parseConversation(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	afterSequence, err := parseOptionalInt(r.URL.Query().Get("after_sequence"))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid after_sequence params")
+	}
+
+	results, err := c.messages.history(context.Background(), u, kind, id, pagination, afterSequence)
+	if err != nil {
+		return messageError(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+func (c *APIController) addReaction(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	return c.react(u, w, r, c.messages.addReaction)
+}
+
+func (c *APIController) removeReaction(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	return c.react(u, w, r, c.messages.removeReaction)
+}
+
+func (c *APIController) react(u User, w http.ResponseWriter, r *http.Request, react func(ctx context.Context, user User, messageID int64, emoji string) (Reaction, error)) (int, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid message id")
+	}
+
+	emoji, err := url.PathUnescape(chi.URLParam(r, "emoji"))
+	if err != nil {
+		return http.StatusBadRequest, errInvalidEmoji
+	}
+
+	reaction, err := react(context.Background(), u, id, emoji)
+	if err != nil {
+		return messageError(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(reaction); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+func (c *APIController) pinMessage(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	return c.togglePin(u, w, r, c.messages.pin)
+}
+
+func (c *APIController) unpinMessage(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	return c.togglePin(u, w, r, c.messages.unpin)
+}
+
+func (c *APIController) togglePin(u User, w http.ResponseWriter, r *http.Request, toggle func(ctx context.Context, user User, messageID int64) (Pin, error)) (int, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid message id")
+	}
+
+	pin, err := toggle(context.Background(), u, id)
+	if err != nil {
+		return messageError(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(pin); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+func (c *APIController) getConversationPins(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	kind, id, err := parseConversation(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	results, err := c.messages.pins(context.Background(), u, kind, id)
+	if err != nil {
+		return messageError(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+func (c *APIController) getThread(u User, w http.ResponseWriter, r *http.Request, pagination Pagination) (int, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid message id")
+	}
+
+	results, err := c.messages.thread(context.Background(), u, id, pagination)
+	if err != nil {
+		return messageError(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+type ConversationSettingsRequest struct {
+	MessageTTLSeconds null.Int `json:"message_ttl_seconds"` // null disables disappearing messages
+}
+
+func (c *APIController) getConversationSettings(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	kind, id, err := parseConversation(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	result, err := c.messages.settings(context.Background(), u, kind, id)
+	if err != nil {
+		return messageError(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+func (c *APIController) updateConversationSettings(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	kind, id, err := parseConversation(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	var req ConversationSettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid request body")
+	}
+
+	result, err := c.messages.setMessageTTL(context.Background(), u, kind, id, req.MessageTTLSeconds)
+	if err != nil {
+		return messageError(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+func (c *APIController) enableAnnouncement(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	return c.setAnnouncement(u, w, r, true)
+}
+
+func (c *APIController) disableAnnouncement(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	return c.setAnnouncement(u, w, r, false)
+}
+
+// only groups have an announcement mode
+func (c *APIController) setAnnouncement(u User, w http.ResponseWriter, r *http.Request, announcement bool) (int, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid group id")
+	}
+
+	result, err := c.messages.setAnnouncement(context.Background(), u, id, announcement)
+	if err != nil {
+		return messageError(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
@@ -0,0 +1,40 @@
+package mig
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// NewMetricsRouter serves the expvar metrics on /debug/vars. It is meant for an internal listener,
+// the command line is not served since flags may hold secrets.
+func NewMetricsRouter() *chi.Mux {
+	r := chi.NewRouter()
+
+	r.Get("/debug/vars", metricsHandler)
+
+	return r
+}
+
+// writes the expvar variables as a JSON object like expvar.Handler, without cmdline
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
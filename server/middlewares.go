@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 )
@@ -18,32 +19,53 @@ type Pagination struct {
 
 func withPagination(next func(w http.ResponseWriter, r *http.Request, pagination Pagination) (int, error)) func(w http.ResponseWriter, r *http.Request) (int, error) {
 	fn := func(w http.ResponseWriter, r *http.Request) (int, error) {
-		page, err := strconv.Atoi(r.URL.Query().Get("page"))
-
+		pagination, err := parsePagination(r)
 		if err != nil {
-			return http.StatusBadRequest, fmt.Errorf("invalid or missing page")
+			return http.StatusBadRequest, err
 		}
 
-		pageSize, err := strconv.Atoi(r.URL.Query().Get("page_size"))
+		return next(w, r, pagination)
+	}
 
-		if err != nil {
-			return http.StatusBadRequest, fmt.Errorf("invalid or missing page_size")
-		}
+	return fn
+}
 
-		pagination := Pagination{
-			page:     page,
-			pageSize: pageSize,
+func withUserPagination(next func(u User, w http.ResponseWriter, r *http.Request, pagination Pagination) (int, error)) func(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	fn := func(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+		pagination, err := parsePagination(r)
+		if err != nil {
+			return http.StatusBadRequest, err
 		}
 
-		return next(w, r, pagination)
+		return next(u, w, r, pagination)
 	}
 
 	return fn
 }
 
+func parsePagination(r *http.Request) (Pagination, error) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+
+	if err != nil {
+		return Pagination{}, fmt.Errorf("invalid or missing page")
+	}
+
+	pageSize, err := strconv.Atoi(r.URL.Query().Get("page_size"))
+
+	if err != nil {
+		return Pagination{}, fmt.Errorf("invalid or missing page_size")
+	}
+
+	return Pagination{
+		page:     page,
+		pageSize: pageSize,
+	}, nil
+}
+
 type ErrorResponse struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int64  `json:"retry_after,omitempty"` // seconds before a rate limited request can be retried
 }
 
 func withError(next func(w http.ResponseWriter, r *http.Request) (int, error)) http.HandlerFunc {
@@ -82,14 +104,66 @@ func withError(next func(w http.ResponseWriter, r *http.Request) (int, error)) h
 	return fn
 }
 
+// limits the size of request bodies, to be used before withError which reads the whole body
+func withMaxBytes(n int64, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > n {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+
+		next(w, r)
+	}
+
+	return fn
+}
+
+// authenticates the user of the access token of the Authorization header, or of the access_token query
+// parameter for the websocket and EventSource clients of browsers which cannot set headers
 func withAuth(c *APIController, next func(u User, w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			token = r.URL.Query().Get("access_token")
+		}
+
+		claims, err := c.auther.Parse(token)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Code:    fmt.Sprintf("%d", http.StatusUnauthorized),
+				Message: "invalid or missing access token",
+			})
+			return
+		}
+
 		user := User{
-			ID:       1,
-			Username: "sudosanam",
+			ID:            claims.ID,
+			Username:      claims.Username,
+			WorkflowState: string(claims.WorkflowState),
+			TokenID:       claims.RegisteredClaims.ID,
+		}
+
+		if !c.rateLimiter.allowUser(w, r, user) {
+			return
 		}
+
 		next(user, w, r)
+	}
+
+	return fn
+}
 
+// adapts a handler returning a status code and an error to be used with withAuth
+func withUserError(next func(u User, w http.ResponseWriter, r *http.Request) (int, error)) func(u User, w http.ResponseWriter, r *http.Request) {
+	fn := func(u User, w http.ResponseWriter, r *http.Request) {
+		withError(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return next(u, w, r)
+		})(w, r)
 	}
 
 	return fn
@@ -0,0 +1,8 @@
+BEGIN;
+
+DROP TABLE IF EXISTS message_edits;
+DROP TABLE IF EXISTS messages;
+
+DROP TYPE IF EXISTS messages__message_type;
+
+COMMIT;
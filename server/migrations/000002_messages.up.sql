@@ -0,0 +1,33 @@
+BEGIN;
+
+CREATE TYPE messages__message_type AS ENUM (
+    'private',
+    'group'
+);
+
+CREATE TABLE messages (
+    id                  BIGSERIAL PRIMARY KEY NOT NULL,
+    sender_id           BIGINT NOT NULL REFERENCES users (id),
+    recipient_id        BIGINT NOT NULL, -- user id or group id depending on message_type
+    message_type        messages__message_type NOT NULL,
+    content             TEXT NOT NULL,
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    edited_at           TIMESTAMPTZ,
+    deleted_at          TIMESTAMPTZ -- tombstone, content is cleared on delete
+);
+
+CREATE INDEX messages_recipient_id_message_type_idx ON messages (recipient_id, message_type);
+CREATE INDEX messages_sender_id_idx ON messages (sender_id);
+
+CREATE TABLE message_edits (
+    id                  BIGSERIAL PRIMARY KEY NOT NULL,
+    message_id          BIGINT NOT NULL REFERENCES messages (id),
+    content             TEXT NOT NULL, -- content before the edit
+    edited_by           BIGINT NOT NULL REFERENCES users (id),
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX message_edits_message_id_idx ON message_edits (message_id);
+
+COMMIT;
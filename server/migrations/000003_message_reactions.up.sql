@@ -0,0 +1,11 @@
+BEGIN;
+
+CREATE TABLE message_reactions (
+    message_id          BIGINT NOT NULL REFERENCES messages (id),
+    user_id             BIGINT NOT NULL REFERENCES users (id),
+    emoji               VARCHAR(32) NOT NULL,
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (message_id, user_id, emoji)
+);
+
+COMMIT;
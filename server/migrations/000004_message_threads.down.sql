@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP INDEX IF EXISTS messages_thread_root_id_idx;
+
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS thread_root_id,
+    DROP COLUMN IF EXISTS reply_to_id;
+
+COMMIT;
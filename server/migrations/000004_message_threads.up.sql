@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE messages
+    ADD COLUMN reply_to_id      BIGINT REFERENCES messages (id), -- quoted message
+    ADD COLUMN thread_root_id   BIGINT REFERENCES messages (id); -- first message of the thread
+
+CREATE INDEX messages_thread_root_id_idx ON messages (thread_root_id);
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE messages
+    ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED;
+
+CREATE INDEX messages_search_vector_idx ON messages USING GIN (search_vector);
+
+COMMIT;
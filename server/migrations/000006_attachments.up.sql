@@ -0,0 +1,21 @@
+BEGIN;
+
+CREATE TABLE attachments (
+    id                  BIGSERIAL PRIMARY KEY NOT NULL,
+    uploader_id         BIGINT NOT NULL REFERENCES users (id),
+    message_id          BIGINT REFERENCES messages (id), -- set when the attachment is sent with a message
+    storage_key         VARCHAR(255) UNIQUE NOT NULL,
+    filename            VARCHAR(255) NOT NULL,
+    mime_type           VARCHAR(255) NOT NULL,
+    size                BIGINT NOT NULL, -- bytes
+    checksum            CHAR(64) NOT NULL, -- hex encoded SHA-256
+    width               INTEGER, -- images only
+    height              INTEGER, -- images only
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    deleted_at          TIMESTAMPTZ
+);
+
+CREATE INDEX attachments_uploader_id_idx ON attachments (uploader_id);
+CREATE INDEX attachments_message_id_idx ON attachments (message_id);
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE attachments
+    DROP COLUMN IF EXISTS processed_at,
+    DROP COLUMN IF EXISTS thumbnails,
+    DROP COLUMN IF EXISTS blurhash;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE attachments
+    ADD COLUMN blurhash         VARCHAR(64),
+    ADD COLUMN thumbnails       JSONB NOT NULL DEFAULT '[]', -- derivatives stored next to the original
+    ADD COLUMN processed_at     TIMESTAMPTZ;
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+DROP TABLE IF EXISTS scheduled_messages;
+
+DROP TYPE IF EXISTS scheduled_messages__workflow_state;
+
+COMMIT;
@@ -0,0 +1,29 @@
+BEGIN;
+
+CREATE TYPE scheduled_messages__workflow_state AS ENUM (
+    'pending',
+    'sent',
+    'cancelled',
+    'failed'
+);
+
+CREATE TABLE scheduled_messages (
+    id                  BIGSERIAL PRIMARY KEY NOT NULL,
+    sender_id           BIGINT NOT NULL REFERENCES users (id),
+    recipient_id        BIGINT NOT NULL, -- user id or group id depending on message_type
+    message_type        messages__message_type NOT NULL,
+    content             TEXT NOT NULL,
+    reply_to_id         BIGINT REFERENCES messages (id),
+    attachment_ids      BIGINT[] NOT NULL DEFAULT '{}',
+    send_at             TIMESTAMPTZ NOT NULL,
+    workflow_state      scheduled_messages__workflow_state NOT NULL DEFAULT 'pending',
+    message_id          BIGINT REFERENCES messages (id), -- set once sent
+    error               TEXT, -- set when sending failed
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX scheduled_messages_pending_send_at_idx ON scheduled_messages (send_at) WHERE workflow_state = 'pending';
+CREATE INDEX scheduled_messages_sender_id_idx ON scheduled_messages (sender_id);
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+DROP TABLE IF EXISTS conversation_settings;
+
+DROP INDEX IF EXISTS messages_expires_at_idx;
+
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS system,
+    DROP COLUMN IF EXISTS expires_at;
+
+COMMIT;
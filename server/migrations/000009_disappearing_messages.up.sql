@@ -0,0 +1,17 @@
+BEGIN;
+
+ALTER TABLE messages
+    ADD COLUMN expires_at   TIMESTAMPTZ, -- set from the conversation message ttl when sent
+    ADD COLUMN system       JSONB; -- structured payload of server generated messages
+
+CREATE INDEX messages_expires_at_idx ON messages (expires_at) WHERE expires_at IS NOT NULL;
+
+CREATE TABLE conversation_settings (
+    conversation_key        VARCHAR(64) PRIMARY KEY NOT NULL, -- private:<lower user id>:<higher user id> or group:<group id>
+    message_ttl_seconds     BIGINT, -- messages do not expire when null
+    updated_by              BIGINT NOT NULL REFERENCES users (id),
+    created_at              TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at              TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+COMMIT;
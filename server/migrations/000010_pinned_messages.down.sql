@@ -0,0 +1,13 @@
+BEGIN;
+
+DROP TABLE IF EXISTS message_pins;
+
+ALTER TABLE conversation_settings
+    DROP COLUMN IF EXISTS announcement;
+
+ALTER TABLE group_users
+    DROP COLUMN IF EXISTS role;
+
+DROP TYPE IF EXISTS group_users__role;
+
+COMMIT;
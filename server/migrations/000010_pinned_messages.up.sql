@@ -0,0 +1,24 @@
+BEGIN;
+
+CREATE TYPE group_users__role AS ENUM (
+    'member',
+    'admin'
+);
+
+-- the group creator is the owner, admins moderate the group with the owner
+ALTER TABLE group_users
+    ADD COLUMN role group_users__role NOT NULL DEFAULT 'member';
+
+ALTER TABLE conversation_settings
+    ADD COLUMN announcement BOOLEAN NOT NULL DEFAULT false; -- only owners and admins can post when true
+
+CREATE TABLE message_pins (
+    message_id          BIGINT PRIMARY KEY NOT NULL REFERENCES messages (id),
+    conversation_key    VARCHAR(64) NOT NULL, -- private:<lower user id>:<higher user id> or group:<group id>
+    pinned_by           BIGINT NOT NULL REFERENCES users (id),
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX message_pins_conversation_key_idx ON message_pins (conversation_key, created_at);
+
+COMMIT;
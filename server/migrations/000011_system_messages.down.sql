@@ -0,0 +1,17 @@
+BEGIN;
+
+DROP TRIGGER IF EXISTS groups_system_messages ON groups;
+DROP FUNCTION IF EXISTS groups_system_messages();
+
+DROP TRIGGER IF EXISTS group_users_system_messages ON group_users;
+DROP FUNCTION IF EXISTS group_users_system_messages();
+
+DROP FUNCTION IF EXISTS insert_system_message(BIGINT, BIGINT, JSONB);
+
+ALTER TABLE groups
+    DROP COLUMN IF EXISTS updated_by;
+
+-- enum values cannot be dropped, system messages are converted to group messages
+UPDATE messages SET message_type = 'group' WHERE message_type = 'system';
+
+COMMIT;
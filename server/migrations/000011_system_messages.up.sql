@@ -0,0 +1,56 @@
+BEGIN;
+
+-- server generated messages of group conversations, recipient_id is the group id
+ALTER TYPE messages__message_type ADD VALUE 'system';
+
+ALTER TABLE groups
+    ADD COLUMN updated_by BIGINT REFERENCES users (id); -- user who last changed the group, the creator when null
+
+-- inserts a system message in the group conversation and notifies the servers to broadcast it
+CREATE FUNCTION insert_system_message(group_id BIGINT, actor_id BIGINT, payload JSONB) RETURNS VOID AS $$
+DECLARE
+    message_id BIGINT;
+BEGIN
+    INSERT INTO messages (sender_id, recipient_id, message_type, content, system)
+    VALUES (actor_id, group_id, 'system', '', payload || jsonb_build_object('actor_id', actor_id))
+    RETURNING id INTO message_id;
+
+    PERFORM pg_notify('mig_system_messages', message_id::TEXT);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION group_users_system_messages() RETURNS TRIGGER AS $$
+DECLARE
+    was_member BOOLEAN := TG_OP = 'UPDATE' AND OLD.workflow_state = 'active' AND OLD.deleted_at IS NULL;
+    is_member BOOLEAN := NEW.workflow_state = 'active' AND NEW.deleted_at IS NULL;
+BEGIN
+    IF is_member AND NOT was_member THEN
+        PERFORM insert_system_message(NEW.group_id, NEW.workflow_completed_by,
+            jsonb_build_object('type', 'member.joined', 'user_id', NEW.user_id));
+    ELSIF was_member AND NOT is_member THEN
+        PERFORM insert_system_message(NEW.group_id, NEW.workflow_completed_by,
+            jsonb_build_object('type', CASE WHEN NEW.workflow_completed_by = NEW.user_id THEN 'member.left' ELSE 'member.removed' END, 'user_id', NEW.user_id));
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER group_users_system_messages AFTER INSERT OR UPDATE ON group_users
+    FOR EACH ROW EXECUTE FUNCTION group_users_system_messages();
+
+CREATE FUNCTION groups_system_messages() RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.name IS DISTINCT FROM OLD.name THEN
+        PERFORM insert_system_message(NEW.id, COALESCE(NEW.updated_by, NEW.created_by),
+            jsonb_build_object('type', 'group.renamed', 'name', NEW.name, 'previous_name', OLD.name));
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER groups_system_messages AFTER UPDATE ON groups
+    FOR EACH ROW EXECUTE FUNCTION groups_system_messages();
+
+COMMIT;
@@ -0,0 +1,20 @@
+BEGIN;
+
+DROP TRIGGER IF EXISTS friendships_outbox ON friendships;
+DROP FUNCTION IF EXISTS friendships_outbox();
+
+CREATE OR REPLACE FUNCTION insert_system_message(group_id BIGINT, actor_id BIGINT, payload JSONB) RETURNS VOID AS $$
+DECLARE
+    message_id BIGINT;
+BEGIN
+    INSERT INTO messages (sender_id, recipient_id, message_type, content, system)
+    VALUES (actor_id, group_id, 'system', '', payload || jsonb_build_object('actor_id', actor_id))
+    RETURNING id INTO message_id;
+
+    PERFORM pg_notify('mig_system_messages', message_id::TEXT);
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TABLE IF EXISTS outbox;
+
+COMMIT;
@@ -0,0 +1,81 @@
+BEGIN;
+
+CREATE TABLE outbox (
+    id                  BIGSERIAL PRIMARY KEY NOT NULL,
+    subject             VARCHAR(255) NOT NULL, -- message broker subject or topic
+    payload             JSONB NOT NULL, -- event published on the subject
+    attempts            INT NOT NULL DEFAULT 0, -- failed publish attempts
+    last_error          TEXT,
+    next_attempt_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    sent_at             TIMESTAMPTZ
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (id) WHERE sent_at IS NULL;
+CREATE INDEX outbox_sent_at_idx ON outbox (sent_at) WHERE sent_at IS NOT NULL;
+
+-- system messages are published through the outbox in the transaction of the group change
+CREATE OR REPLACE FUNCTION insert_system_message(group_id BIGINT, actor_id BIGINT, payload JSONB) RETURNS VOID AS $$
+DECLARE
+    m messages;
+BEGIN
+    INSERT INTO messages (sender_id, recipient_id, message_type, content, system)
+    VALUES (actor_id, group_id, 'system', '', payload || jsonb_build_object('actor_id', actor_id))
+    RETURNING * INTO m;
+
+    INSERT INTO outbox (subject, payload)
+    SELECT 'mig.messages.created', jsonb_build_object(
+        'type', 'message.created',
+        'recipients', (
+            SELECT jsonb_agg(DISTINCT user_id) FROM (
+                SELECT gu.user_id FROM group_users gu
+                WHERE gu.group_id = m.recipient_id AND gu.workflow_state = 'active' AND gu.deleted_at IS NULL
+                UNION
+                SELECT (m.system->>'user_id')::BIGINT WHERE m.system ? 'user_id'
+            ) members
+        ),
+        'message', jsonb_build_object(
+            'id', m.id,
+            'sender_id', m.sender_id,
+            'recipient_id', m.recipient_id,
+            'content', m.content,
+            'message_type', m.message_type,
+            'reply_to_id', m.reply_to_id,
+            'thread_root_id', m.thread_root_id,
+            'created_at', m.created_at,
+            'edited_at', m.edited_at,
+            'deleted_at', m.deleted_at,
+            'expires_at', m.expires_at,
+            'system', m.system,
+            'last_reply_at', NULL
+        )
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION friendships_outbox() RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO outbox (subject, payload)
+    VALUES ('mig.friendships.updated', jsonb_build_object(
+        'type', 'friendship.updated',
+        'recipients', jsonb_build_array(NEW.requester_id, NEW.user_id),
+        'friendship', jsonb_build_object(
+            'id', NEW.id,
+            'requester_id', NEW.requester_id,
+            'user_id', NEW.user_id,
+            'workflow_state', NEW.workflow_state,
+            'workflow_completed_by', NEW.workflow_completed_by,
+            'created_at', NEW.created_at,
+            'updated_at', NEW.updated_at,
+            'deleted_at', NEW.deleted_at
+        )
+    ));
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER friendships_outbox AFTER INSERT OR UPDATE ON friendships
+    FOR EACH ROW EXECUTE FUNCTION friendships_outbox();
+
+COMMIT;
@@ -0,0 +1,70 @@
+BEGIN;
+
+CREATE OR REPLACE FUNCTION insert_system_message(group_id BIGINT, actor_id BIGINT, payload JSONB) RETURNS VOID AS $$
+DECLARE
+    m messages;
+BEGIN
+    INSERT INTO messages (sender_id, recipient_id, message_type, content, system)
+    VALUES (actor_id, group_id, 'system', '', payload || jsonb_build_object('actor_id', actor_id))
+    RETURNING * INTO m;
+
+    INSERT INTO outbox (subject, payload)
+    SELECT 'mig.messages.created', jsonb_build_object(
+        'type', 'message.created',
+        'recipients', (
+            SELECT jsonb_agg(DISTINCT user_id) FROM (
+                SELECT gu.user_id FROM group_users gu
+                WHERE gu.group_id = m.recipient_id AND gu.workflow_state = 'active' AND gu.deleted_at IS NULL
+                UNION
+                SELECT (m.system->>'user_id')::BIGINT WHERE m.system ? 'user_id'
+            ) members
+        ),
+        'message', jsonb_build_object(
+            'id', m.id,
+            'sender_id', m.sender_id,
+            'recipient_id', m.recipient_id,
+            'content', m.content,
+            'message_type', m.message_type,
+            'reply_to_id', m.reply_to_id,
+            'thread_root_id', m.thread_root_id,
+            'created_at', m.created_at,
+            'edited_at', m.edited_at,
+            'deleted_at', m.deleted_at,
+            'expires_at', m.expires_at,
+            'system', m.system,
+            'last_reply_at', NULL
+        )
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION friendships_outbox() RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO outbox (subject, payload)
+    VALUES ('mig.friendships.updated', jsonb_build_object(
+        'type', 'friendship.updated',
+        'recipients', jsonb_build_array(NEW.requester_id, NEW.user_id),
+        'friendship', jsonb_build_object(
+            'id', NEW.id,
+            'requester_id', NEW.requester_id,
+            'user_id', NEW.user_id,
+            'workflow_state', NEW.workflow_state,
+            'workflow_completed_by', NEW.workflow_completed_by,
+            'created_at', NEW.created_at,
+            'updated_at', NEW.updated_at,
+            'deleted_at', NEW.deleted_at
+        )
+    ));
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS sequence;
+
+DROP FUNCTION IF EXISTS next_conversation_sequence(VARCHAR);
+
+DROP TABLE IF EXISTS conversation_sequences;
+
+COMMIT;
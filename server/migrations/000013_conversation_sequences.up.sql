@@ -0,0 +1,106 @@
+BEGIN;
+
+CREATE TABLE conversation_sequences (
+    conversation_key    VARCHAR(64) PRIMARY KEY NOT NULL, -- private:<lower user id>:<higher user id> or group:<group id>
+    last_sequence       BIGINT NOT NULL
+);
+
+-- returns the next sequence number of the conversation, the row lock orders concurrent messages
+CREATE FUNCTION next_conversation_sequence(VARCHAR) RETURNS BIGINT AS $$
+    INSERT INTO conversation_sequences (conversation_key, last_sequence)
+    VALUES ($1, 1)
+    ON CONFLICT (conversation_key) DO UPDATE SET last_sequence = conversation_sequences.last_sequence + 1
+    RETURNING last_sequence;
+$$ LANGUAGE sql;
+
+ALTER TABLE messages
+    ADD COLUMN sequence BIGINT; -- monotonic per conversation, assigned when the message is persisted
+
+UPDATE messages SET sequence = numbered.sequence
+FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY conversation_key ORDER BY id) AS sequence
+    FROM (
+        SELECT id, CASE
+            WHEN message_type = 'private' THEN 'private:' || LEAST(sender_id, recipient_id) || ':' || GREATEST(sender_id, recipient_id)
+            ELSE 'group:' || recipient_id
+        END AS conversation_key
+        FROM messages
+    ) keyed
+) numbered
+WHERE messages.id = numbered.id;
+
+INSERT INTO conversation_sequences (conversation_key, last_sequence)
+SELECT CASE
+    WHEN message_type = 'private' THEN 'private:' || LEAST(sender_id, recipient_id) || ':' || GREATEST(sender_id, recipient_id)
+    ELSE 'group:' || recipient_id
+END, MAX(sequence)
+FROM messages
+GROUP BY 1;
+
+ALTER TABLE messages
+    ALTER COLUMN sequence SET NOT NULL;
+
+CREATE OR REPLACE FUNCTION insert_system_message(group_id BIGINT, actor_id BIGINT, payload JSONB) RETURNS VOID AS $$
+DECLARE
+    m messages;
+BEGIN
+    INSERT INTO messages (sender_id, recipient_id, message_type, content, system, sequence)
+    VALUES (actor_id, group_id, 'system', '', payload || jsonb_build_object('actor_id', actor_id), next_conversation_sequence('group:' || group_id))
+    RETURNING * INTO m;
+
+    INSERT INTO outbox (subject, payload)
+    SELECT 'mig.messages.created', jsonb_build_object(
+        'type', 'message.created',
+        'conversation_key', 'group:' || m.recipient_id,
+        'recipients', (
+            SELECT jsonb_agg(DISTINCT user_id) FROM (
+                SELECT gu.user_id FROM group_users gu
+                WHERE gu.group_id = m.recipient_id AND gu.workflow_state = 'active' AND gu.deleted_at IS NULL
+                UNION
+                SELECT (m.system->>'user_id')::BIGINT WHERE m.system ? 'user_id'
+            ) members
+        ),
+        'message', jsonb_build_object(
+            'id', m.id,
+            'sequence', m.sequence,
+            'sender_id', m.sender_id,
+            'recipient_id', m.recipient_id,
+            'content', m.content,
+            'message_type', m.message_type,
+            'reply_to_id', m.reply_to_id,
+            'thread_root_id', m.thread_root_id,
+            'created_at', m.created_at,
+            'edited_at', m.edited_at,
+            'deleted_at', m.deleted_at,
+            'expires_at', m.expires_at,
+            'system', m.system,
+            'last_reply_at', NULL
+        )
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION friendships_outbox() RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO outbox (subject, payload)
+    VALUES ('mig.friendships.updated', jsonb_build_object(
+        'type', 'friendship.updated',
+        'conversation_key', 'private:' || LEAST(NEW.requester_id, NEW.user_id) || ':' || GREATEST(NEW.requester_id, NEW.user_id),
+        'recipients', jsonb_build_array(NEW.requester_id, NEW.user_id),
+        'friendship', jsonb_build_object(
+            'id', NEW.id,
+            'requester_id', NEW.requester_id,
+            'user_id', NEW.user_id,
+            'workflow_state', NEW.workflow_state,
+            'workflow_completed_by', NEW.workflow_completed_by,
+            'created_at', NEW.created_at,
+            'updated_at', NEW.updated_at,
+            'deleted_at', NEW.deleted_at
+        )
+    ));
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMIT;
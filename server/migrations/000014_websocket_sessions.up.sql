@@ -0,0 +1,14 @@
+BEGIN;
+
+-- websocket sessions resumed by reconnecting clients, events they missed are replayed from the outbox
+CREATE TABLE websocket_sessions (
+    id                  UUID PRIMARY KEY NOT NULL,
+    user_id             BIGINT NOT NULL REFERENCES users (id),
+    last_event_id       BIGINT NOT NULL DEFAULT 0, -- id in the outbox of the last event delivered on the session
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX websocket_sessions_user_id_idx ON websocket_sessions (user_id, updated_at);
+
+COMMIT;
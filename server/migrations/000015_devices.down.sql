@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS sender_device_id;
+
+DROP TABLE IF EXISTS devices;
+
+COMMIT;
@@ -0,0 +1,19 @@
+BEGIN;
+
+-- devices of a user, registered when they connect to the websocket
+CREATE TABLE devices (
+    id                  UUID PRIMARY KEY NOT NULL,
+    user_id             BIGINT NOT NULL REFERENCES users (id),
+    platform            VARCHAR(32) NOT NULL, -- e.g. web, ios, android, desktop
+    name                VARCHAR(255) NOT NULL,
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_active_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    revoked_at          TIMESTAMPTZ -- revoked devices can no longer connect
+);
+
+CREATE INDEX devices_user_id_idx ON devices (user_id, last_active_at);
+
+ALTER TABLE messages
+    ADD COLUMN sender_device_id UUID REFERENCES devices (id); -- device the message was sent from, other devices of the sender show it as sent
+
+COMMIT;
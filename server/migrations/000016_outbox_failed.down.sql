@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP INDEX IF EXISTS outbox_failed_at_idx;
+DROP INDEX IF EXISTS outbox_pending_idx;
+CREATE INDEX outbox_pending_idx ON outbox (id) WHERE sent_at IS NULL;
+
+ALTER TABLE outbox DROP COLUMN IF EXISTS failed_at;
+
+COMMIT;
@@ -0,0 +1,10 @@
+BEGIN;
+
+-- events failing to publish after the maximum attempts are parked so later events are relayed
+ALTER TABLE outbox ADD COLUMN failed_at TIMESTAMPTZ;
+
+DROP INDEX IF EXISTS outbox_pending_idx;
+CREATE INDEX outbox_pending_idx ON outbox (id) WHERE sent_at IS NULL AND failed_at IS NULL;
+CREATE INDEX outbox_failed_at_idx ON outbox (failed_at) WHERE failed_at IS NOT NULL;
+
+COMMIT;
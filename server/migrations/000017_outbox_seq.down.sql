@@ -0,0 +1,10 @@
+BEGIN;
+
+DROP INDEX IF EXISTS outbox_recipients_idx;
+DROP INDEX IF EXISTS outbox_seq_idx;
+
+ALTER TABLE outbox DROP COLUMN IF EXISTS seq;
+
+DROP SEQUENCE IF EXISTS outbox_seq;
+
+COMMIT;
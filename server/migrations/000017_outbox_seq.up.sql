@@ -0,0 +1,18 @@
+BEGIN;
+
+-- events are numbered by the relay in the order they are published, sessions resume from this number
+-- because ids are assigned at insert and transactions commit in another order
+CREATE SEQUENCE outbox_seq;
+
+ALTER TABLE outbox ADD COLUMN seq BIGINT;
+
+-- sessions hold ids of the events sent so far
+UPDATE outbox SET seq = id WHERE sent_at IS NOT NULL;
+SELECT setval('outbox_seq', (SELECT last_value FROM outbox_id_seq));
+
+CREATE UNIQUE INDEX outbox_seq_idx ON outbox (seq);
+
+-- replays look up the events of a user
+CREATE INDEX outbox_recipients_idx ON outbox USING GIN ((payload->'recipients') jsonb_path_ops);
+
+COMMIT;
@@ -0,0 +1,12 @@
+BEGIN;
+
+-- access tokens a device connected with, a token cannot connect once its device is revoked
+CREATE TABLE device_tokens (
+    token_id            VARCHAR(255) PRIMARY KEY NOT NULL, -- jti claim of the access token
+    device_id           UUID NOT NULL REFERENCES devices (id),
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX device_tokens_device_id_idx ON device_tokens (device_id);
+
+COMMIT;
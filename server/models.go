@@ -4,4 +4,6 @@ type User struct {
 	ID            int64  `json:"id"`
 	Username      string `json:"username"`
 	WorkflowState string `json:"workflow_state"`
+	DeviceID      string `json:"-"` // device of the websocket connection, empty on REST requests
+	TokenID       string `json:"-"` // jti claim of the access token of the request, devices are bound to it
 }
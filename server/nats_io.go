@@ -1,8 +1,7 @@
 package mig
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
 	"fmt"
 
 	"github.com/nats-io/nats.go"
@@ -28,19 +27,21 @@ func NewNats(protocol, user, pass, host, port string) (*Nats, error) {
 	return &nats, nil
 }
 
-func (n *Nats) publish(subject string, message Message) error {
-	var data bytes.Buffer
-
-	enc := gob.NewEncoder(&data)
-
-	err := enc.Encode(message)
+func (n *Nats) publish(subject string, event Event) error {
+	data, headers, err := encodeEvent(event)
 	if err != nil {
 		msg := fmt.Sprintf("encode: %s", err.Error())
 		log.Error().Msg(msg)
 		return err
 	}
 
-	err = n.conn.Publish(subject, data.Bytes())
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	for key, value := range headers {
+		msg.Header.Set(key, value)
+	}
+
+	err = n.conn.PublishMsg(msg)
 	if err != nil {
 		msg := fmt.Sprintf("publish: %s", err.Error())
 		log.Error().Msg(msg)
@@ -50,9 +51,10 @@ func (n *Nats) publish(subject string, message Message) error {
 	return nil
 }
 
-func (n *Nats) subscribe(subject string) {
+// delivers events published on the subject to the clients connected to the hub
+func (n *Nats) Subscribe(subject string, hub *Hub) {
 	n.conn.Subscribe(subject, func(msg *nats.Msg) {
-		handleMessage(msg)
+		handleMessage(hub, msg)
 	})
 	n.conn.Flush()
 
@@ -62,11 +64,40 @@ func (n *Nats) subscribe(subject string) {
 	}
 }
 
+// stops the subscriptions once their in-flight events are delivered, flushes published events and closes the connection
+func (n *Nats) Drain(ctx context.Context) error {
+	closed := make(chan struct{})
+	n.conn.SetClosedHandler(func(*nats.Conn) {
+		close(closed)
+	})
+
+	if err := n.conn.Drain(); err != nil {
+		return err
+	}
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		n.conn.Close()
+		return ctx.Err()
+	}
+}
+
 func (n *Nats) Close() {
 	log.Info().Msg("closing NATS connection...")
 	n.conn.Close()
 }
 
-func handleMessage(msg *nats.Msg) {
+func handleMessage(hub *Hub, msg *nats.Msg) {
+	event, err := decodeEvent(msg.Header.Get(headerEventVersion), msg.Data)
+	if err != nil {
+		msg := fmt.Sprintf("decode: %s", err.Error())
+		log.Error().Msg(msg)
+		return
+	}
 
+	if err := deliverEvent(hub, event); err != nil {
+		log.Error().Msg(err.Error())
+	}
 }
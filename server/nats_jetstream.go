@@ -0,0 +1,163 @@
+package mig
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+// JetStreamConfig configures the stream storing events and the durable consumer of the node.
+type JetStreamConfig struct {
+	Stream     string        // name of the stream
+	Subjects   []string      // subjects stored in the stream
+	Durable    string        // name of the consumer of the node, each node receives every event
+	MaxDeliver int           // deliveries of an event before it is dropped
+	AckWait    time.Duration // time before an unacknowledged event is redelivered
+	MaxAge     time.Duration // events older than this are removed, kept forever when 0
+	MaxBytes   int64         // size of the stream before the oldest events are removed, unlimited when -1
+	MaxMsgs    int64         // events in the stream before the oldest are removed, unlimited when -1
+	Replicas   int           // copies of the stream in a cluster
+
+	// time after which the server deletes the consumer of a node that stopped consuming, so nodes
+	// replaced by a redeploy do not leave their consumer behind. Kept forever when 0.
+	InactiveThreshold time.Duration
+}
+
+// JetStream is the broker mode of NATS storing events in a stream, they are redelivered until
+// acknowledged by the consumer of every node.
+type JetStream struct {
+	nats           *Nats
+	js             jetstream.JetStream
+	stream         jetstream.Stream
+	config         JetStreamConfig
+	consumeContext jetstream.ConsumeContext
+}
+
+// creates or updates the stream of the config
+func (n *Nats) JetStream(ctx context.Context, config JetStreamConfig) (*JetStream, error) {
+	js, err := jetstream.New(n.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      config.Stream,
+		Subjects:  config.Subjects,
+		Retention: jetstream.LimitsPolicy,
+		Storage:   jetstream.FileStorage,
+		MaxAge:    config.MaxAge,
+		MaxBytes:  config.MaxBytes,
+		MaxMsgs:   config.MaxMsgs,
+		Replicas:  config.Replicas,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("stream %s: %w", config.Stream, err)
+	}
+
+	return &JetStream{
+		nats:   n,
+		js:     js,
+		stream: stream,
+		config: config,
+	}, nil
+}
+
+// waits for the stream to store the event
+func (j *JetStream) publish(subject string, event Event) error {
+	data, headers, err := encodeEvent(event)
+	if err != nil {
+		return err
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	for key, value := range headers {
+		msg.Header.Set(key, value)
+	}
+
+	_, err = j.js.PublishMsg(context.Background(), msg)
+
+	return err
+}
+
+// delivers events of the stream to the clients connected to the hub until the context is done.
+// The durable consumer starts with new events the first time the node runs.
+func (j *JetStream) Subscribe(ctx context.Context, hub *Hub) error {
+	return j.subscribe(ctx, func(event Event) error {
+		return deliverEvent(hub, event)
+	})
+}
+
+// consumes the events of the stream with deliver, events are acknowledged when it succeeds
+func (j *JetStream) subscribe(ctx context.Context, deliver func(event Event) error) error {
+	consumer, err := j.stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:           j.config.Durable,
+		AckPolicy:         jetstream.AckExplicitPolicy,
+		AckWait:           j.config.AckWait,
+		MaxDeliver:        j.config.MaxDeliver,
+		DeliverPolicy:     jetstream.DeliverNewPolicy,
+		FilterSubjects:    j.config.Subjects,
+		InactiveThreshold: j.config.InactiveThreshold,
+	})
+	if err != nil {
+		return fmt.Errorf("consumer %s: %w", j.config.Durable, err)
+	}
+
+	j.consumeContext, err = consumer.Consume(func(msg jetstream.Msg) {
+		j.handle(deliver, msg)
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		j.consumeContext.Stop()
+	}()
+
+	return nil
+}
+
+// stops consuming once the buffered events are delivered and acknowledged, then drains the NATS connection
+func (j *JetStream) Drain(ctx context.Context) error {
+	if j.consumeContext != nil {
+		j.consumeContext.Drain()
+
+		select {
+		case <-j.consumeContext.Closed():
+		case <-ctx.Done():
+			j.nats.Close()
+			return ctx.Err()
+		}
+	}
+
+	return j.nats.Drain(ctx)
+}
+
+// events that cannot be decoded are terminated, failed deliveries are redelivered after a delay
+func (j *JetStream) handle(deliver func(event Event) error, msg jetstream.Msg) {
+	event, err := decodeEvent(msg.Headers().Get(headerEventVersion), msg.Data())
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("decode: %s", err.Error()))
+		if err := msg.Term(); err != nil {
+			log.Error().Msg(fmt.Sprintf("term: %s", err.Error()))
+		}
+		return
+	}
+
+	if err := deliver(event); err != nil {
+		log.Error().Msg(err.Error())
+		if err := msg.NakWithDelay(j.config.AckWait / 10); err != nil {
+			log.Error().Msg(fmt.Sprintf("nak: %s", err.Error()))
+		}
+		return
+	}
+
+	if err := msg.Ack(); err != nil {
+		log.Error().Msg(fmt.Sprintf("ack: %s", err.Error()))
+	}
+}
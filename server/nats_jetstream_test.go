@@ -0,0 +1,226 @@
+package mig
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// starts an embedded NATS server with JetStream and returns a stream of mig.messages.* with a durable consumer
+func newTestJetStream(t *testing.T, maxDeliver int) *JetStream {
+	t.Helper()
+
+	opts := natsserver.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+
+	srv := natsserver.RunServer(&opts)
+	t.Cleanup(srv.Shutdown)
+
+	conn, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+
+	n := &Nats{conn: conn}
+
+	js, err := n.JetStream(context.Background(), JetStreamConfig{
+		Stream:            "MIG_TEST",
+		Subjects:          []string{"mig.messages.*"},
+		Durable:           "node",
+		MaxDeliver:        maxDeliver,
+		AckWait:           time.Second,
+		MaxBytes:          -1,
+		MaxMsgs:           -1,
+		Replicas:          1,
+		InactiveThreshold: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return js
+}
+
+// records the deliveries of events, failing the first failures of them
+type testDeliveries struct {
+	mu       sync.Mutex
+	failures int
+	events   []Event
+	calls    chan Event
+}
+
+func newTestDeliveries(failures int) *testDeliveries {
+	return &testDeliveries{
+		failures: failures,
+		calls:    make(chan Event, 100),
+	}
+}
+
+func (d *testDeliveries) deliver(event Event) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.calls <- event
+
+	if d.failures > 0 {
+		d.failures--
+		return errors.New("delivery failed")
+	}
+
+	d.events = append(d.events, event)
+
+	return nil
+}
+
+func (d *testDeliveries) delivered() []Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]Event{}, d.events...)
+}
+
+// waits for n deliveries and fails when another one follows within the quiet period
+func (d *testDeliveries) expect(t *testing.T, n int, quiet time.Duration) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-d.calls:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d deliveries, want %d", i, n)
+		}
+	}
+
+	select {
+	case event := <-d.calls:
+		t.Fatalf("unexpected delivery of event %d after %d deliveries", event.ID, n)
+	case <-time.After(quiet):
+	}
+}
+
+func (j *JetStream) testAckPending(t *testing.T) int {
+	t.Helper()
+
+	consumer, err := j.stream.Consumer(context.Background(), j.config.Durable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := consumer.Info(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info.NumAckPending + int(info.NumPending)
+}
+
+func TestJetStreamAck(t *testing.T) {
+	js := newTestJetStream(t, 3)
+	deliveries := newTestDeliveries(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := js.subscribe(ctx, deliveries.deliver); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := js.publish(subjectMessagesCreated, Event{ID: 1, Type: EventTypeMessageCreated, Recipients: []int64{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries.expect(t, 1, 1500*time.Millisecond)
+
+	if events := deliveries.delivered(); len(events) != 1 || events[0].ID != 1 {
+		t.Fatalf("delivered events %v, want event 1", events)
+	}
+
+	if pending := js.testAckPending(t); pending != 0 {
+		t.Errorf("%d events left unacknowledged", pending)
+	}
+}
+
+func TestJetStreamRedeliversAfterNak(t *testing.T) {
+	js := newTestJetStream(t, 3)
+	deliveries := newTestDeliveries(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := js.subscribe(ctx, deliveries.deliver); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := js.publish(subjectMessagesCreated, Event{ID: 2, Type: EventTypeMessageCreated, Recipients: []int64{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// redelivered after the delay of the nak, a tenth of the ack wait
+	deliveries.expect(t, 2, 1500*time.Millisecond)
+
+	if events := deliveries.delivered(); len(events) != 1 || events[0].ID != 2 {
+		t.Fatalf("delivered events %v, want event 2", events)
+	}
+
+	if pending := js.testAckPending(t); pending != 0 {
+		t.Errorf("%d events left unacknowledged", pending)
+	}
+}
+
+func TestJetStreamMaxDeliver(t *testing.T) {
+	js := newTestJetStream(t, 3)
+	deliveries := newTestDeliveries(1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := js.subscribe(ctx, deliveries.deliver); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := js.publish(subjectMessagesCreated, Event{ID: 3, Type: EventTypeMessageCreated, Recipients: []int64{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// dropped after MaxDeliver deliveries, longer than the ack wait without another one
+	deliveries.expect(t, 3, 2*time.Second)
+
+	if events := deliveries.delivered(); len(events) != 0 {
+		t.Fatalf("delivered events %v, want none", events)
+	}
+}
+
+func TestJetStreamTerminatesMalformedEvents(t *testing.T) {
+	js := newTestJetStream(t, 3)
+	deliveries := newTestDeliveries(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := js.subscribe(ctx, deliveries.deliver); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := nats.NewMsg(subjectMessagesCreated)
+	msg.Header.Set(headerEventVersion, eventSchemaVersion)
+	msg.Data = []byte("not protobuf")
+
+	if _, err := js.js.PublishMsg(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries.expect(t, 0, 1500*time.Millisecond)
+
+	if pending := js.testAckPending(t); pending != 0 {
+		t.Errorf("%d events left unacknowledged", pending)
+	}
+}
@@ -0,0 +1,294 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// OutboxEvent is an event written to the outbox in the transaction of the change it describes,
+// the relay publishes it on the message broker once the transaction is committed.
+type OutboxEvent struct {
+	Subject string
+	Event   Event
+}
+
+// returns the event describing a change to the message, called inside the transaction of the change
+type messageEvent func(m Message) (OutboxEvent, error)
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// writes the events to the outbox with the executor, a transaction or the database
+func enqueueEvents(ctx context.Context, db execer, events ...OutboxEvent) error {
+	for _, e := range events {
+		payload, err := json.Marshal(e.Event)
+		if err != nil {
+			return err
+		}
+
+		if _, err := db.ExecContext(ctx, `INSERT INTO outbox (subject, payload) VALUES ($1, $2)`, e.Subject, string(payload)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OutboxRelay publishes the events of the outbox on the message broker in the order they were written.
+// A failed publish is retried with a backoff before any later event is published, events failing maxAttempts
+// times are parked with failed_at so they cannot stall the outbox. Servers take turns with an advisory lock
+// so a single relay runs at a time.
+//
+// Published events are numbered from outbox_seq in the order they are published, the number is the id of
+// the event seen by clients. Unlike outbox ids, assigned at insert by transactions committing in any order,
+// numbers of later batches are always greater, so clients resuming from a number miss no event.
+type OutboxRelay struct {
+	db          *sql.DB
+	broker      MessageBroker
+	interval    time.Duration // time between polls of the outbox
+	batchSize   int           // events published per transaction
+	maxBackoff  time.Duration // longest wait before retrying a failed publish
+	maxAttempts int           // publish attempts before an event is parked
+	retention   time.Duration // time sent events are kept
+
+	done chan struct{} // closed when Run returns
+}
+
+func NewOutboxRelay(db *sql.DB, broker MessageBroker, interval time.Duration, batchSize int, maxBackoff time.Duration, maxAttempts int, retention time.Duration) *OutboxRelay {
+	return &OutboxRelay{
+		db:          db,
+		broker:      broker,
+		interval:    interval,
+		batchSize:   batchSize,
+		maxBackoff:  maxBackoff,
+		maxAttempts: maxAttempts,
+		retention:   retention,
+		done:        make(chan struct{}),
+	}
+}
+
+// relays the outbox until the context is done, the batch being relayed is committed before it returns
+func (r *OutboxRelay) Run(ctx context.Context) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.relay(ctx)
+		case <-cleanup.C:
+			if _, err := r.db.ExecContext(ctx, `DELETE FROM outbox WHERE sent_at < $1`, time.Now().Add(-r.retention)); err != nil {
+				msg := fmt.Sprintf("delete sent outbox events: %s", err.Error())
+				log.Error().Msg(msg)
+			}
+		}
+	}
+}
+
+// Done returns a channel closed once Run returned
+func (r *OutboxRelay) Done() <-chan struct{} {
+	return r.done
+}
+
+// relays batches until the outbox is drained, a publish fails or the context is done.
+// A batch is not canceled once started so that published events are marked sent.
+func (r *OutboxRelay) relay(ctx context.Context) {
+	for ctx.Err() == nil {
+		relayed, err := r.relayBatch(context.WithoutCancel(ctx))
+		if err != nil {
+			msg := fmt.Sprintf("relay outbox: %s", err.Error())
+			log.Error().Msg(msg)
+			return
+		}
+
+		if relayed < r.batchSize {
+			return
+		}
+	}
+}
+
+type outboxRow struct {
+	id            int64
+	seq           int64 // number of the event once published
+	subject       string
+	payload       []byte
+	attempts      int
+	nextAttemptAt time.Time
+}
+
+// publishes the oldest pending events, stopping at the first failure so events keep their order.
+// Returns the number of events published or parked.
+func (r *OutboxRelay) relayBatch(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock(hashtext('outbox'))`).Scan(&locked); err != nil {
+		return 0, err
+	}
+
+	// another server is relaying, or sessions are replaying the published events
+	if !locked {
+		return 0, nil
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, subject, payload, attempts, next_attempt_at FROM outbox
+		WHERE sent_at IS NULL AND failed_at IS NULL
+		ORDER BY id
+		LIMIT $1`,
+		r.batchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	pending := []outboxRow{}
+	for rows.Next() {
+		var row outboxRow
+		if err := rows.Scan(&row.id, &row.subject, &row.payload, &row.attempts, &row.nextAttemptAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := []int64{}
+	seqs := []int64{}
+	parked := 0
+	var publishErr error
+
+	for _, row := range pending {
+		// later events wait for the retry of a failed one
+		if row.nextAttemptAt.After(time.Now()) {
+			break
+		}
+
+		if err := tx.QueryRowContext(ctx, `SELECT nextval('outbox_seq')`).Scan(&row.seq); err != nil {
+			return 0, err
+		}
+
+		if publishErr = r.publish(row); publishErr != nil {
+			// the event is parked and the relay moves on to later events
+			if row.attempts+1 >= r.maxAttempts {
+				_, err := tx.ExecContext(ctx,
+					`UPDATE outbox SET attempts = attempts + 1, last_error = $2, failed_at = NOW() WHERE id = $1`,
+					row.id, publishErr.Error(),
+				)
+				if err != nil {
+					return 0, err
+				}
+
+				msg := fmt.Sprintf("park outbox event %d after %d attempts: %s", row.id, row.attempts+1, publishErr.Error())
+				log.Error().Msg(msg)
+
+				publishErr = nil
+				parked++
+				continue
+			}
+
+			backoff := min(time.Second<<min(row.attempts, 16), r.maxBackoff)
+
+			_, err := tx.ExecContext(ctx,
+				`UPDATE outbox SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3 WHERE id = $1`,
+				row.id, publishErr.Error(), time.Now().Add(backoff),
+			)
+			if err != nil {
+				return 0, err
+			}
+
+			publishErr = fmt.Errorf("publish event %d: %w", row.id, publishErr)
+			break
+		}
+
+		sent = append(sent, row.id)
+		seqs = append(seqs, row.seq)
+	}
+
+	if len(sent) > 0 {
+		_, err := tx.ExecContext(ctx,
+			`UPDATE outbox SET sent_at = NOW(), seq = s.seq
+			FROM UNNEST($1::BIGINT[], $2::BIGINT[]) AS s (id, seq)
+			WHERE outbox.id = s.id`,
+			sent, seqs,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(sent) + parked, publishErr
+}
+
+func (r *OutboxRelay) publish(row outboxRow) error {
+	var event Event
+	if err := json.Unmarshal(row.payload, &event); err != nil {
+		return err
+	}
+	event.ID = row.seq
+
+	return r.broker.publish(row.subject, event)
+}
+
+func (r *MessagesRepositoryPostgreSQL) enqueueEvents(ctx context.Context, events ...OutboxEvent) error {
+	return enqueueEvents(ctx, r.db, events...)
+}
+
+func (r *MessagesRepositoryPostgreSQL) enqueueMessageEvent(ctx context.Context, tx *sql.Tx, m Message, event messageEvent) error {
+	e, err := event(m)
+	if err != nil {
+		return err
+	}
+
+	return enqueueEvents(ctx, tx, e)
+}
+
+// runs the statement and writes the event to the outbox in the same transaction when rows changed.
+// Returns false when no row changed.
+func (r *MessagesRepositoryPostgreSQL) execWithEvent(ctx context.Context, event OutboxEvent, query string, args ...any) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	if err := enqueueEvents(ctx, tx, event); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
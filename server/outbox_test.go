@@ -0,0 +1,206 @@
+package mig
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// passes arrays through like the pgx driver, which encodes them as PostgreSQL arrays
+type arrayConverter struct{}
+
+func (arrayConverter) ConvertValue(v any) (driver.Value, error) {
+	if ids, ok := v.([]int64); ok {
+		return ids, nil
+	}
+
+	return driver.DefaultParameterConverter.ConvertValue(v)
+}
+
+// matches an array argument equal to the expected one
+type arrayArg []int64
+
+func (a arrayArg) Match(v driver.Value) bool {
+	ids, ok := v.([]int64)
+	return ok && slices.Equal(ids, a)
+}
+
+// broker recording the published events, publishes of the event types in fail return an error
+type testBroker struct {
+	mu        sync.Mutex
+	fail      map[EventType]bool
+	published []Event
+	attempts  int
+}
+
+func (b *testBroker) publish(topic string, event Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.attempts++
+	if b.fail[event.Type] {
+		return errors.New("broker unavailable")
+	}
+
+	b.published = append(b.published, event)
+
+	return nil
+}
+
+func newTestOutboxRelay(t *testing.T, broker MessageBroker, batchSize, maxAttempts int) (*OutboxRelay, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(arrayConverter{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewOutboxRelay(db, broker, time.Second, batchSize, time.Minute, maxAttempts, time.Hour), mock
+}
+
+// pending events of the outbox from firstID, read by the relay at the start of a batch
+func outboxRows(t *testing.T, firstID int64, attempts int, types ...EventType) *sqlmock.Rows {
+	t.Helper()
+
+	rows := sqlmock.NewRows([]string{"id", "subject", "payload", "attempts", "next_attempt_at"})
+	for i, eventType := range types {
+		payload, err := json.Marshal(Event{Type: eventType, Recipients: []int64{1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows.AddRow(firstID+int64(i), subjectMessagesCreated, payload, attempts, time.Now().Add(-time.Second))
+	}
+
+	return rows
+}
+
+func expectOutboxBatch(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock\(hashtext\('outbox'\)\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery(`SELECT id, subject, payload, attempts, next_attempt_at FROM outbox`).
+		WillReturnRows(rows)
+}
+
+func expectOutboxSeq(mock sqlmock.Sqlmock, seq int64) {
+	mock.ExpectQuery(`SELECT nextval\('outbox_seq'\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(seq))
+}
+
+// a failed publish is retried with a backoff, and parked once it failed maxAttempts times
+func TestOutboxRelayRetriesAndParks(t *testing.T) {
+	broker := &testBroker{fail: map[EventType]bool{EventTypeMessageCreated: true}}
+	relay, mock := newTestOutboxRelay(t, broker, 10, 3)
+
+	for attempts := 0; attempts < 2; attempts++ {
+		expectOutboxBatch(mock, outboxRows(t, 1, attempts, EventTypeMessageCreated, EventTypeMessageDeleted))
+		expectOutboxSeq(mock, int64(attempts+1))
+		mock.ExpectExec(`UPDATE outbox SET attempts = attempts \+ 1, last_error = \$2, next_attempt_at = \$3 WHERE id = \$1`).
+			WithArgs(1, "broker unavailable", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		relayed, err := relay.relayBatch(context.Background())
+		if err == nil || relayed != 0 {
+			t.Fatalf("attempt %d: relayed %d events with error %v, want none relayed and an error", attempts+1, relayed, err)
+		}
+	}
+
+	// the event is parked and the relay moves on to the next one
+	expectOutboxBatch(mock, outboxRows(t, 1, 2, EventTypeMessageCreated, EventTypeMessageDeleted))
+	expectOutboxSeq(mock, 3)
+	mock.ExpectExec(`UPDATE outbox SET attempts = attempts \+ 1, last_error = \$2, failed_at = NOW\(\) WHERE id = \$1`).
+		WithArgs(1, "broker unavailable").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectOutboxSeq(mock, 4)
+	mock.ExpectExec(`UPDATE outbox SET sent_at = NOW\(\), seq = s.seq`).
+		WithArgs(arrayArg{2}, arrayArg{4}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	relayed, err := relay.relayBatch(context.Background())
+	if err != nil || relayed != 2 {
+		t.Fatalf("relayed %d events with error %v, want 2 relayed", relayed, err)
+	}
+
+	if broker.attempts != 4 {
+		t.Errorf("%d publishes, want 4", broker.attempts)
+	}
+
+	if len(broker.published) != 1 || broker.published[0].Type != EventTypeMessageDeleted || broker.published[0].ID != 4 {
+		t.Errorf("published events %+v, want the later event numbered 4", broker.published)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// events are numbered in the order they are published, across batches
+func TestOutboxRelaySeq(t *testing.T) {
+	broker := &testBroker{}
+	relay, mock := newTestOutboxRelay(t, broker, 2, 3)
+
+	expectOutboxBatch(mock, outboxRows(t, 1, 0, EventTypeMessageCreated, EventTypeMessageUpdated))
+	expectOutboxSeq(mock, 7)
+	expectOutboxSeq(mock, 8)
+	mock.ExpectExec(`UPDATE outbox SET sent_at = NOW\(\), seq = s.seq`).
+		WithArgs(arrayArg{1, 2}, arrayArg{7, 8}).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	expectOutboxBatch(mock, outboxRows(t, 3, 0, EventTypeMessageDeleted))
+	expectOutboxSeq(mock, 9)
+	mock.ExpectExec(`UPDATE outbox SET sent_at = NOW\(\), seq = s.seq`).
+		WithArgs(arrayArg{3}, arrayArg{9}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// relays full batches until the outbox is drained
+	relay.relay(context.Background())
+
+	ids := []int64{}
+	for _, event := range broker.published {
+		ids = append(ids, event.ID)
+	}
+
+	if !slices.Equal(ids, []int64{7, 8, 9}) {
+		t.Errorf("published events numbered %v, want 7, 8, 9", ids)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// a relay running on another server holds the lock, the batch is skipped
+func TestOutboxRelayLocked(t *testing.T) {
+	broker := &testBroker{}
+	relay, mock := newTestOutboxRelay(t, broker, 10, 3)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock\(hashtext\('outbox'\)\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+	mock.ExpectRollback()
+
+	relayed, err := relay.relayBatch(context.Background())
+	if err != nil || relayed != 0 {
+		t.Fatalf("relayed %d events with error %v, want none", relayed, err)
+	}
+
+	if broker.attempts != 0 {
+		t.Errorf("%d publishes, want none", broker.attempts)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
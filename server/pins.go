@@ -0,0 +1,120 @@
+package mig
+
+import (
+	"context"
+	"slices"
+)
+
+func (s *MessageService) pin(ctx context.Context, user User, messageID int64) (Pin, error) {
+	return s.togglePin(ctx, user, messageID, true)
+}
+
+func (s *MessageService) unpin(ctx context.Context, user User, messageID int64) (Pin, error) {
+	return s.togglePin(ctx, user, messageID, false)
+}
+
+// pins or unpins the message, both participants of private conversations and the owners
+// and admins of groups can change pins. Events are only written when the pins changed.
+func (s *MessageService) togglePin(ctx context.Context, user User, messageID int64, pinned bool) (Pin, error) {
+	message, err := s.repo.getMessageByID(ctx, messageID)
+	if err != nil {
+		return Pin{}, err
+	}
+
+	if pinned && message.DeletedAt.Valid {
+		return Pin{}, errMessageDeleted
+	}
+
+	recipients, err := s.recipients(ctx, message)
+	if err != nil {
+		return Pin{}, err
+	}
+
+	if !slices.Contains(recipients, user.ID) {
+		return Pin{}, errNotParticipant
+	}
+
+	if message.MessageType == MessageTypeGroup || message.MessageType == MessageTypeSystem {
+		if err := s.checkGroupModerator(ctx, user, message.RecipientID); err != nil {
+			return Pin{}, err
+		}
+	}
+
+	pin := Pin{
+		MessageID: messageID,
+		PinnedBy:  user.ID,
+	}
+
+	event := func(p Pin) OutboxEvent {
+		p.Message = &message
+
+		subject, eventType := subjectMessagesPinned, EventTypeMessagePinned
+		if !pinned {
+			subject, eventType = subjectMessagesUnpinned, EventTypeMessageUnpinned
+		}
+
+		return OutboxEvent{
+			Subject: subject,
+			Event: Event{
+				Type:            eventType,
+				ConversationKey: conversationKey(message),
+				Recipients:      recipients,
+				Pin:             &p,
+			},
+		}
+	}
+
+	if pinned {
+		pin, _, err = s.repo.pinMessage(ctx, pin, conversationKey(message), s.pinLimit, event)
+	} else {
+		_, err = s.repo.unpinMessage(ctx, messageID, event(pin))
+	}
+	if err != nil {
+		return Pin{}, err
+	}
+
+	pin.Message = &message
+
+	return pin, nil
+}
+
+func (s *MessageService) pins(ctx context.Context, user User, kind MessageType, conversationID int64) ([]Pin, error) {
+	if err := s.checkParticipant(ctx, user, kind, conversationID); err != nil {
+		return nil, err
+	}
+
+	pins, err := s.repo.getConversationPins(ctx, conversationKey(conversationMessage(user, kind, conversationID)))
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []Message{}
+	for _, p := range pins {
+		messages = append(messages, *p.Message)
+	}
+
+	if err := s.withAttachments(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	for i := range pins {
+		pins[i].Message = &messages[i]
+	}
+
+	return pins, nil
+}
+
+// returns the unpin event of a pin removed with its deleted message, for the recipients of the deletion
+func unpinnedEvent(pin Pin, deleted OutboxEvent) OutboxEvent {
+	pin.Message = deleted.Event.Message
+
+	return OutboxEvent{
+		Subject: subjectMessagesUnpinned,
+		Event: Event{
+			Type:            EventTypeMessageUnpinned,
+			ConversationKey: deleted.Event.ConversationKey,
+			Recipients:      deleted.Event.Recipients,
+			Pin:             &pin,
+		},
+	}
+}
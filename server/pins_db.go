@@ -0,0 +1,104 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var errPinLimitReached = errors.New("the conversation has reached its limit of pinned messages")
+
+type Pin struct {
+	MessageID int64     `json:"message_id"`
+	PinnedBy  int64     `json:"pinned_by"`
+	PinnedAt  time.Time `json:"pinned_at"`
+	Message   *Message  `json:"message,omitempty"`
+}
+
+// returns false when the message is already pinned. Pins of a conversation are counted under
+// an advisory lock so concurrent pins cannot exceed the limit.
+func (r *MessagesRepositoryPostgreSQL) pinMessage(ctx context.Context, pin Pin, key string, limit int, event func(p Pin) OutboxEvent) (Pin, bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Pin{}, false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, key); err != nil {
+		return Pin{}, false, err
+	}
+
+	err = tx.QueryRowContext(ctx,
+		`SELECT pinned_by, created_at FROM message_pins WHERE message_id = $1`,
+		pin.MessageID,
+	).Scan(&pin.PinnedBy, &pin.PinnedAt)
+	if err == nil {
+		return pin, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Pin{}, false, err
+	}
+
+	var count int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM message_pins WHERE conversation_key = $1`, key).Scan(&count); err != nil {
+		return Pin{}, false, err
+	}
+
+	if count >= limit {
+		return Pin{}, false, errPinLimitReached
+	}
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO message_pins (message_id, conversation_key, pinned_by)
+		VALUES ($1, $2, $3)
+		RETURNING created_at`,
+		pin.MessageID, key, pin.PinnedBy,
+	).Scan(&pin.PinnedAt)
+	if err != nil {
+		return Pin{}, false, err
+	}
+
+	if err := enqueueEvents(ctx, tx, event(pin)); err != nil {
+		return Pin{}, false, err
+	}
+
+	return pin, true, tx.Commit()
+}
+
+// returns false when the message was not pinned
+func (r *MessagesRepositoryPostgreSQL) unpinMessage(ctx context.Context, messageID int64, event OutboxEvent) (bool, error) {
+	return r.execWithEvent(ctx, event, `DELETE FROM message_pins WHERE message_id = $1`, messageID)
+}
+
+// returns the pinned messages of the conversation, most recently pinned first
+func (r *MessagesRepositoryPostgreSQL) getConversationPins(ctx context.Context, key string) ([]Pin, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+messageColumns+`, pinned_by, pinned_at FROM messages
+		JOIN (
+			SELECT message_id, pinned_by, created_at AS pinned_at FROM message_pins WHERE conversation_key = $1
+		) pins ON pins.message_id = messages.id
+		WHERE `+notExpired+`
+		ORDER BY pinned_at DESC`,
+		key,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []Pin{}
+
+	for rows.Next() {
+		var pin Pin
+		m, err := scanMessage(rows, &pin.PinnedBy, &pin.PinnedAt)
+		if err != nil {
+			return nil, err
+		}
+		pin.MessageID = m.ID
+		pin.Message = &m
+		results = append(results, pin)
+	}
+
+	return results, rows.Err()
+}
@@ -0,0 +1,112 @@
+package mig
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies are the networks of the reverse proxies and load balancers in front of the server.
+// Forwarding headers are only honoured on requests sent by them, other clients could set any address.
+type TrustedProxies []netip.Prefix
+
+// parses CIDRs and addresses of single proxies, empty entries are ignored
+func ParseTrustedProxies(cidrs []string) (TrustedProxies, error) {
+	proxies := TrustedProxies{}
+
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %s: %w", cidr, err)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %s: %w", cidr, err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+
+	return proxies, nil
+}
+
+func (p TrustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// middleware replacing the remote address of requests sent by a trusted proxy with the address of the client.
+// It is the last address of X-Forwarded-For that is not a trusted proxy, or X-Real-IP without X-Forwarded-For.
+func (p TrustedProxies) realIP(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if ip, ok := p.forwardedIP(r); ok {
+			r.RemoteAddr = ip.String()
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// returns false when the request was not sent by a trusted proxy or has no valid forwarding header
+func (p TrustedProxies) forwardedIP(r *http.Request) (netip.Addr, bool) {
+	if len(p) == 0 {
+		return netip.Addr{}, false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !p.contains(peer) {
+		return netip.Addr{}, false
+	}
+
+	// each proxy appends the address it received the request from
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+
+		var client netip.Addr
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+
+			client = addr.Unmap()
+			if !p.contains(client) {
+				break
+			}
+		}
+
+		return client, client.IsValid()
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
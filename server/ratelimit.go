@@ -0,0 +1,200 @@
+package mig
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimit allows bursts of Requests, refilled at Requests per Period. Limits with no requests are disabled.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Requests > 0 && l.Period > 0
+}
+
+// RateLimitResult is the state of a bucket after taking a token.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int           // tokens left in the bucket
+	RetryAfter time.Duration // time before the next token, zero when allowed
+	Reset      time.Duration // time before the bucket is full
+}
+
+// RateLimitStore keeps token buckets by key. Stores shared by servers enforce limits across replicas.
+type RateLimitStore interface {
+	take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+// returns the result of a bucket holding tokens after the take
+func rateLimitResult(limit RateLimit, tokens float64, allowed bool) RateLimitResult {
+	perToken := float64(limit.Period) / float64(limit.Requests)
+
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     limit.Requests,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(limit.Requests) - tokens) * perToken),
+	}
+
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) * perToken)
+	}
+
+	return result
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refills the bucket for the time elapsed since its last take and takes a token when one is left
+func (b *tokenBucket) take(limit RateLimit, now time.Time) RateLimitResult {
+	capacity := float64(limit.Requests)
+
+	if b.updated.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = min(capacity, b.tokens+now.Sub(b.updated).Seconds()*capacity/limit.Period.Seconds())
+	}
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	return rateLimitResult(limit, b.tokens, allowed)
+}
+
+// RateLimitStoreMemory keeps buckets in memory, limits apply per server.
+type RateLimitStoreMemory struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	swept   time.Time
+}
+
+type memoryBucket struct {
+	tokenBucket
+	period time.Duration
+}
+
+func NewRateLimitStoreMemory() *RateLimitStoreMemory {
+	return &RateLimitStoreMemory{
+		buckets: make(map[string]*memoryBucket),
+		swept:   time.Now(),
+	}
+}
+
+func (s *RateLimitStoreMemory) take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	// buckets idle for longer than their period are full, they are removed every minute
+	if now.Sub(s.swept) > time.Minute {
+		for k, b := range s.buckets {
+			if now.Sub(b.updated) > b.period {
+				delete(s.buckets, k)
+			}
+		}
+		s.swept = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{}
+		s.buckets[key] = b
+	}
+	b.period = limit.Period
+
+	return b.take(limit, now), nil
+}
+
+// refills and takes a token atomically with the clock of the Redis server, buckets expire once full
+var takeTokenScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1])
+local updated = tonumber(bucket[2])
+if tokens == nil then
+	tokens = capacity
+else
+	tokens = math.min(capacity, tokens + (now - updated) * capacity / period)
+end
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], period)
+
+return {allowed, tostring(tokens)}
+`)
+
+// RateLimitStoreRedis keeps buckets in Redis, limits apply across servers.
+type RateLimitStoreRedis struct {
+	client *redis.Client
+	prefix string // prefix of the keys of buckets
+}
+
+func NewRateLimitStoreRedis(ctx context.Context, addr, password string, db int, prefix string) (*RateLimitStoreRedis, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &RateLimitStoreRedis{
+		client: client,
+		prefix: prefix,
+	}, nil
+}
+
+func (s *RateLimitStoreRedis) Close() error {
+	return s.client.Close()
+}
+
+func (s *RateLimitStoreRedis) take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	values, err := takeTokenScript.Run(ctx, s.client, []string{s.prefix + key}, limit.Requests, limit.Period.Milliseconds()).Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	if len(values) != 2 {
+		return RateLimitResult{}, fmt.Errorf("take token: unexpected reply %v", values)
+	}
+
+	allowed, _ := values[0].(int64)
+	reply, _ := values[1].(string)
+
+	tokens, err := strconv.ParseFloat(reply, 64)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	return rateLimitResult(limit, tokens, allowed == 1), nil
+}
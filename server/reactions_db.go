@@ -0,0 +1,71 @@
+package mig
+
+import (
+	"context"
+	"time"
+)
+
+type Reaction struct {
+	MessageID int64     `json:"message_id"`
+	UserID    int64     `json:"user_id"`
+	Emoji     string    `json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReactionCount aggregates the reactions of a message by emoji.
+// Reacted is true when the requesting user is one of the reactors.
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int64  `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
+// returns false when the user already reacted to the message with the emoji
+func (r *MessagesRepositoryPostgreSQL) addReaction(ctx context.Context, reaction Reaction, event OutboxEvent) (bool, error) {
+	return r.execWithEvent(ctx, event,
+		`INSERT INTO message_reactions (message_id, user_id, emoji)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`,
+		reaction.MessageID, reaction.UserID, reaction.Emoji,
+	)
+}
+
+// returns false when the user did not react to the message with the emoji
+func (r *MessagesRepositoryPostgreSQL) removeReaction(ctx context.Context, reaction Reaction, event OutboxEvent) (bool, error) {
+	return r.execWithEvent(ctx, event,
+		`DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3`,
+		reaction.MessageID, reaction.UserID, reaction.Emoji,
+	)
+}
+
+// returns reaction counts keyed by message id, emojis are ordered by first use
+func (r *MessagesRepositoryPostgreSQL) getReactionCounts(ctx context.Context, messageIDs []int64, userID int64) (map[int64][]ReactionCount, error) {
+	results := map[int64][]ReactionCount{}
+
+	if len(messageIDs) == 0 {
+		return results, nil
+	}
+
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT message_id, emoji, COUNT(*), BOOL_OR(user_id = $2) FROM message_reactions
+		WHERE message_id = ANY($1)
+		GROUP BY message_id, emoji
+		ORDER BY message_id, MIN(created_at)`,
+		messageIDs, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID int64
+		var rc ReactionCount
+		if err := rows.Scan(&messageID, &rc.Emoji, &rc.Count, &rc.Reacted); err != nil {
+			return nil, err
+		}
+		results[messageID] = append(results[messageID], rc)
+	}
+
+	return results, rows.Err()
+}
@@ -0,0 +1,83 @@
+package mig
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Reaper deletes expired messages of conversations with a message ttl, with their attachments,
+// and tells the recipients to drop them.
+type Reaper struct {
+	repo      MessagesRepository
+	messages  *MessageService
+	storage   BlobStorage
+	interval  time.Duration // time between runs
+	batchSize int           // messages deleted per transaction
+}
+
+func NewReaper(repo MessagesRepository, messages *MessageService, storage BlobStorage, interval time.Duration, batchSize int) *Reaper {
+	return &Reaper{
+		repo:      repo,
+		messages:  messages,
+		storage:   storage,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reap(ctx)
+		}
+	}
+}
+
+// deletes expired messages in batches until none is left or the context is done. A batch is not canceled
+// once started so that the blobs of the deleted messages are deleted too.
+func (r *Reaper) reap(ctx context.Context) {
+	for ctx.Err() == nil {
+		batchCtx := context.WithoutCancel(ctx)
+
+		expired, err := r.repo.deleteExpiredMessages(batchCtx, r.batchSize, r.expiredEvent)
+		if err != nil {
+			msg := fmt.Sprintf("delete expired messages: %s", err.Error())
+			log.Error().Msg(msg)
+			return
+		}
+
+		// blobs are deleted once the rows are gone, a failure leaves an orphan blob but no dangling row
+		for _, key := range expired.StorageKeys {
+			if err := r.storage.delete(batchCtx, key); err != nil {
+				msg := fmt.Sprintf("delete blob %s: %s", key, err.Error())
+				log.Error().Msg(msg)
+			}
+		}
+
+		if len(expired.Messages) < r.batchSize {
+			return
+		}
+	}
+}
+
+// the event of an expired message only identifies it, clients drop their copy
+func (r *Reaper) expiredEvent(m Message) (OutboxEvent, error) {
+	return r.messages.event(subjectMessagesExpired, EventTypeMessageExpired)(Message{
+		ID:          m.ID,
+		Sequence:    m.Sequence,
+		SenderID:    m.SenderID,
+		RecipientID: m.RecipientID,
+		MessageType: m.MessageType,
+		CreatedAt:   m.CreatedAt,
+		ExpiresAt:   m.ExpiresAt,
+	})
+}
@@ -0,0 +1,412 @@
+package mig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// RedisBrokerConfig configures the stream of events and the consumer group of the node.
+type RedisBrokerConfig struct {
+	Stream        string        // stream of events
+	Channel       string        // Pub/Sub channel of ephemeral events, they are not stored
+	Group         string        // consumer group of the node, each node receives every event
+	MaxLen        int64         // approximate length the stream is trimmed to
+	BatchSize     int64         // events read at once
+	ClaimMinIdle  time.Duration // time before pending events of a crashed process are reclaimed
+	ClaimInterval time.Duration // time between reclaims of pending events
+	MaxDeliver    int64         // deliveries of an event before it is dropped, retried forever when 0
+	GroupTTL      time.Duration // idle time before the consumer group of a stopped node is destroyed, kept forever when 0
+}
+
+// RedisBroker publishes events on a Redis stream read by a consumer group per node.
+// Events left pending by a crashed process of the node are reclaimed by the next one,
+// groups of nodes that stopped, e.g. replaced by a redeploy, are destroyed by the other nodes.
+type RedisBroker struct {
+	client   *redis.Client
+	config   RedisBrokerConfig
+	consumer string // name of the process in the consumer group
+
+	stop    context.CancelFunc // stops the subscription
+	readers sync.WaitGroup     // loops of the subscription
+}
+
+func NewRedisBroker(ctx context.Context, addr, password string, db int, config RedisBrokerConfig) (*RedisBroker, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &RedisBroker{
+		client:   client,
+		config:   config,
+		consumer: config.Group + "-" + uuid.NewString(),
+	}, nil
+}
+
+func (r *RedisBroker) Close() error {
+	return r.client.Close()
+}
+
+// ephemeral events are published on the Pub/Sub channel as the schema version, a space and the
+// encoded event. Other events are appended to the stream, trimmed to about MaxLen events.
+func (r *RedisBroker) publish(subject string, event Event) error {
+	data, headers, err := encodeEvent(event)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	if event.Type.ephemeral() {
+		return r.client.Publish(ctx, r.config.Channel, headers[headerEventVersion]+" "+string(data)).Err()
+	}
+
+	return r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: r.config.Stream,
+		MaxLen: r.config.MaxLen,
+		Approx: true,
+		Values: map[string]any{
+			"subject": subject,
+			"version": headers[headerEventVersion],
+			"data":    data,
+		},
+	}).Err()
+}
+
+// delivers events to the clients connected to the hub until the context is done.
+// The consumer group starts with new events the first time the node runs.
+func (r *RedisBroker) Subscribe(ctx context.Context, hub *Hub) error {
+	return r.subscribe(ctx, func(event Event) error {
+		return deliverEvent(hub, event)
+	})
+}
+
+// consumes the events of the stream and the channel with deliver, events are acknowledged when it succeeds
+func (r *RedisBroker) subscribe(ctx context.Context, deliver func(event Event) error) error {
+	if err := r.createGroup(ctx); err != nil {
+		return err
+	}
+
+	pubsub := r.client.Subscribe(ctx, r.config.Channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	ctx, r.stop = context.WithCancel(ctx)
+
+	r.readers.Add(3)
+	go func() {
+		defer r.readers.Done()
+		r.read(ctx, deliver)
+	}()
+	go func() {
+		defer r.readers.Done()
+		r.reclaim(ctx, deliver)
+	}()
+	go func() {
+		defer r.readers.Done()
+		r.receive(ctx, deliver, pubsub)
+	}()
+
+	return nil
+}
+
+// creates the consumer group of the node reading new events, unless it exists
+func (r *RedisBroker) createGroup(ctx context.Context) error {
+	err := r.client.XGroupCreateMkStream(ctx, r.config.Stream, r.config.Group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("consumer group %s: %w", r.config.Group, err)
+	}
+
+	return nil
+}
+
+// stops the subscription once the events being delivered are acknowledged, then closes the client
+func (r *RedisBroker) Drain(ctx context.Context) error {
+	if r.stop != nil {
+		r.stop()
+
+		stopped := make(chan struct{})
+		go func() {
+			r.readers.Wait()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			r.client.Close()
+			return ctx.Err()
+		}
+	}
+
+	return r.client.Close()
+}
+
+func (r *RedisBroker) read(ctx context.Context, deliver func(event Event) error) {
+	for ctx.Err() == nil {
+		streams, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    r.config.Group,
+			Consumer: r.consumer,
+			Streams:  []string{r.config.Stream, ">"},
+			Count:    r.config.BatchSize,
+			Block:    5 * time.Second,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error().Msg(fmt.Sprintf("read stream %s: %s", r.config.Stream, err.Error()))
+
+				// the group was destroyed while the node was unreachable for longer than GroupTTL
+				if strings.HasPrefix(err.Error(), "NOGROUP") {
+					if err := r.createGroup(ctx); err != nil {
+						log.Error().Msg(err.Error())
+					}
+				}
+
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		for _, stream := range streams {
+			r.handle(ctx, deliver, stream.Messages)
+		}
+	}
+}
+
+// claims events pending for longer than ClaimMinIdle, e.g. read by a process of the node that crashed
+// or whose delivery failed, removes the consumers left without pending events and the idle groups
+func (r *RedisBroker) reclaim(ctx context.Context, deliver func(event Event) error) {
+	ticker := time.NewTicker(r.config.ClaimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start := "0-0"
+		for {
+			messages, next, err := r.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   r.config.Stream,
+				Group:    r.config.Group,
+				Consumer: r.consumer,
+				MinIdle:  r.config.ClaimMinIdle,
+				Start:    start,
+				Count:    r.config.BatchSize,
+			}).Result()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error().Msg(fmt.Sprintf("claim pending events: %s", err.Error()))
+				}
+				break
+			}
+
+			messages, err = r.dropExhausted(ctx, messages)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error().Msg(fmt.Sprintf("drop exhausted events: %s", err.Error()))
+				}
+				break
+			}
+
+			r.handle(ctx, deliver, messages)
+
+			if next == "0-0" {
+				break
+			}
+			start = next
+		}
+
+		consumers, err := r.client.XInfoConsumers(ctx, r.config.Stream, r.config.Group).Result()
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("consumers of group %s: %s", r.config.Group, err.Error()))
+			continue
+		}
+
+		for _, c := range consumers {
+			if c.Name != r.consumer && c.Pending == 0 && c.Idle > r.config.ClaimMinIdle {
+				if err := r.client.XGroupDelConsumer(ctx, r.config.Stream, r.config.Group, c.Name).Err(); err != nil {
+					log.Error().Msg(fmt.Sprintf("delete consumer %s: %s", c.Name, err.Error()))
+				}
+			}
+		}
+
+		if err := r.destroyIdleGroups(ctx); err != nil && ctx.Err() == nil {
+			log.Error().Msg(fmt.Sprintf("destroy idle groups: %s", err.Error()))
+		}
+	}
+}
+
+// acknowledges the claimed events delivered more than MaxDeliver times without delivering them again.
+// Returns the events left to deliver.
+func (r *RedisBroker) dropExhausted(ctx context.Context, messages []redis.XMessage) ([]redis.XMessage, error) {
+	if r.config.MaxDeliver <= 0 || len(messages) == 0 {
+		return messages, nil
+	}
+
+	// events read by the node meanwhile fall in the range too
+	pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   r.config.Stream,
+		Group:    r.config.Group,
+		Start:    messages[0].ID,
+		End:      messages[len(messages)-1].ID,
+		Count:    int64(len(messages)) + r.config.BatchSize,
+		Consumer: r.consumer,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := map[string]int64{}
+	for _, p := range pending {
+		deliveries[p.ID] = p.RetryCount
+	}
+
+	remaining := []redis.XMessage{}
+	drops := []string{}
+
+	for _, msg := range messages {
+		if deliveries[msg.ID] > r.config.MaxDeliver {
+			log.Error().Msg(fmt.Sprintf("drop event %s after %d deliveries", msg.ID, deliveries[msg.ID]-1))
+			drops = append(drops, msg.ID)
+			continue
+		}
+		remaining = append(remaining, msg)
+	}
+
+	if len(drops) > 0 {
+		if err := r.client.XAck(ctx, r.config.Stream, r.config.Group, drops...).Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return remaining, nil
+}
+
+// destroys the groups of other nodes whose consumers have all been idle for longer than GroupTTL
+func (r *RedisBroker) destroyIdleGroups(ctx context.Context) error {
+	if r.config.GroupTTL <= 0 {
+		return nil
+	}
+
+	groups, err := r.client.XInfoGroups(ctx, r.config.Stream).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		// groups without consumers are being created by a starting node
+		if g.Name == r.config.Group || g.Consumers == 0 {
+			continue
+		}
+
+		consumers, err := r.client.XInfoConsumers(ctx, r.config.Stream, g.Name).Result()
+		if err != nil {
+			return err
+		}
+
+		idle := true
+		for _, c := range consumers {
+			if c.Idle <= r.config.GroupTTL {
+				idle = false
+				break
+			}
+		}
+
+		if !idle {
+			continue
+		}
+
+		if err := r.client.XGroupDestroy(ctx, r.config.Stream, g.Name).Err(); err != nil {
+			return err
+		}
+
+		log.Info().Msg(fmt.Sprintf("destroyed idle consumer group %s", g.Name))
+	}
+
+	return nil
+}
+
+// acknowledges delivered events and events that cannot be decoded, failed deliveries stay pending and are
+// reclaimed until they were delivered MaxDeliver times
+func (r *RedisBroker) handle(ctx context.Context, deliver func(event Event) error, messages []redis.XMessage) {
+	acks := []string{}
+
+	for _, msg := range messages {
+		version, _ := msg.Values["version"].(string)
+		data, _ := msg.Values["data"].(string)
+
+		event, err := decodeEvent(version, []byte(data))
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("decode event %s: %s", msg.ID, err.Error()))
+			acks = append(acks, msg.ID)
+			continue
+		}
+
+		if err := deliver(event); err != nil {
+			log.Error().Msg(err.Error())
+			continue
+		}
+
+		acks = append(acks, msg.ID)
+	}
+
+	if len(acks) == 0 {
+		return
+	}
+
+	// delivered events are acknowledged while the subscription stops
+	if err := r.client.XAck(context.WithoutCancel(ctx), r.config.Stream, r.config.Group, acks...).Err(); err != nil {
+		log.Error().Msg(fmt.Sprintf("ack events: %s", err.Error()))
+	}
+}
+
+func (r *RedisBroker) receive(ctx context.Context, deliver func(event Event) error, pubsub *redis.PubSub) {
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			version, data, _ := strings.Cut(msg.Payload, " ")
+
+			event, err := decodeEvent(version, []byte(data))
+			if err != nil {
+				log.Error().Msg(fmt.Sprintf("decode ephemeral event: %s", err.Error()))
+				continue
+			}
+
+			if err := deliver(event); err != nil {
+				log.Error().Msg(err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package mig
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// returns the address of the Redis server of MIG_TEST_REDIS_ADDR, or of an in-memory one
+func testRedisAddr(t *testing.T) string {
+	t.Helper()
+
+	if addr := os.Getenv("MIG_TEST_REDIS_ADDR"); addr != "" {
+		return addr
+	}
+
+	return miniredis.RunT(t).Addr()
+}
+
+// connects a broker of the node group to a stream unique to the test
+func newTestRedisBroker(t *testing.T, addr, stream, group string, maxDeliver int64, groupTTL time.Duration) *RedisBroker {
+	t.Helper()
+
+	r, err := NewRedisBroker(context.Background(), addr, "", 0, RedisBrokerConfig{
+		Stream:        stream,
+		Channel:       stream + ":ephemeral",
+		Group:         group,
+		MaxLen:        1000,
+		BatchSize:     10,
+		ClaimMinIdle:  100 * time.Millisecond,
+		ClaimInterval: 100 * time.Millisecond,
+		MaxDeliver:    maxDeliver,
+		GroupTTL:      groupTTL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	return r
+}
+
+func testRedisStream() string {
+	return "mig:test:" + uuid.NewString()
+}
+
+func (r *RedisBroker) testPending(t *testing.T) int64 {
+	t.Helper()
+
+	pending, err := r.client.XPending(context.Background(), r.config.Stream, r.config.Group).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pending.Count
+}
+
+func TestRedisBrokerAck(t *testing.T) {
+	r := newTestRedisBroker(t, testRedisAddr(t), testRedisStream(), "node", 3, 0)
+	deliveries := newTestDeliveries(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := r.subscribe(ctx, deliveries.deliver); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.publish(subjectMessagesCreated, Event{ID: 1, Type: EventTypeMessageCreated, Recipients: []int64{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries.expect(t, 1, 500*time.Millisecond)
+
+	if events := deliveries.delivered(); len(events) != 1 || events[0].ID != 1 {
+		t.Fatalf("delivered events %v, want event 1", events)
+	}
+
+	if pending := r.testPending(t); pending != 0 {
+		t.Errorf("%d events left unacknowledged", pending)
+	}
+}
+
+func TestRedisBrokerReclaimsFailedDeliveries(t *testing.T) {
+	r := newTestRedisBroker(t, testRedisAddr(t), testRedisStream(), "node", 3, 0)
+	deliveries := newTestDeliveries(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := r.subscribe(ctx, deliveries.deliver); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.publish(subjectMessagesCreated, Event{ID: 2, Type: EventTypeMessageCreated, Recipients: []int64{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// claimed again once idle for ClaimMinIdle
+	deliveries.expect(t, 2, 500*time.Millisecond)
+
+	if events := deliveries.delivered(); len(events) != 1 || events[0].ID != 2 {
+		t.Fatalf("delivered events %v, want event 2", events)
+	}
+
+	if pending := r.testPending(t); pending != 0 {
+		t.Errorf("%d events left unacknowledged", pending)
+	}
+}
+
+func TestRedisBrokerMaxDeliver(t *testing.T) {
+	r := newTestRedisBroker(t, testRedisAddr(t), testRedisStream(), "node", 3, 0)
+	deliveries := newTestDeliveries(1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := r.subscribe(ctx, deliveries.deliver); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.publish(subjectMessagesCreated, Event{ID: 3, Type: EventTypeMessageCreated, Recipients: []int64{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// dropped after MaxDeliver deliveries, several reclaims pass without another one
+	deliveries.expect(t, 3, time.Second)
+
+	if events := deliveries.delivered(); len(events) != 0 {
+		t.Fatalf("delivered events %v, want none", events)
+	}
+
+	if pending := r.testPending(t); pending != 0 {
+		t.Errorf("%d events left unacknowledged", pending)
+	}
+}
+
+func TestRedisBrokerDestroysIdleGroups(t *testing.T) {
+	addr := testRedisAddr(t)
+	stream := testRedisStream()
+
+	r := newTestRedisBroker(t, addr, stream, "node", 3, 300*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// group of a node that stopped after reading and reclaiming an event, and of a node starting.
+	// The in-memory server only reports the idle time of consumers that claimed an event with XCLAIM.
+	stopped := newTestRedisBroker(t, addr, stream, "stopped", 3, 0)
+	if err := stopped.createGroup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := stopped.publish(subjectMessagesCreated, Event{ID: 4, Type: EventTypeMessageCreated, Recipients: []int64{1}}); err != nil {
+		t.Fatal(err)
+	}
+	streams, err := stopped.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    "stopped",
+		Consumer: stopped.consumer,
+		Streams:  []string{stream, ">"},
+		Count:    1,
+		Block:    -1,
+	}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stopped.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   stream,
+		Group:    "stopped",
+		Consumer: stopped.consumer,
+		Messages: []string{streams[0].Messages[0].ID},
+	}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	starting := newTestRedisBroker(t, addr, stream, "starting", 3, 0)
+	if err := starting.createGroup(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.subscribe(ctx, newTestDeliveries(0).deliver); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		groups, err := r.client.XInfoGroups(ctx, stream).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := map[string]bool{}
+		for _, g := range groups {
+			names[g.Name] = true
+		}
+
+		if !names["stopped"] {
+			if !names["node"] || !names["starting"] {
+				t.Fatalf("groups %v, want node and starting kept", names)
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("idle group not destroyed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRedisBrokerEphemeralEvents(t *testing.T) {
+	r := newTestRedisBroker(t, testRedisAddr(t), testRedisStream(), "node", 3, 0)
+	deliveries := newTestDeliveries(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := r.subscribe(ctx, deliveries.deliver); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.publish(string(EventTypeTyping), Event{Type: EventTypeTyping, Recipients: []int64{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries.expect(t, 1, 500*time.Millisecond)
+
+	// not stored in the stream
+	length, err := r.client.XLen(ctx, r.config.Stream).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != 0 {
+		t.Errorf("stream has %d events, want none", length)
+	}
+}
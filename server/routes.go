@@ -8,30 +8,71 @@ import (
 	"github.com/go-chi/cors"
 )
 
-func NewRouter(c *APIController) *chi.Mux {
+// forwarding headers of requests are honoured when they are sent by one of the proxies
+func NewRouter(c *APIController, proxies TrustedProxies) *chi.Mux {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(proxies.realIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 
-	r.Use(middleware.Timeout(time.Second * 15))
-
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		ExposedHeaders:   []string{"Link", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
 
-	r.HandleFunc("/ws", withAuth(c, c.hub.ServeWebSockets))
+	r.HandleFunc("/ws", withAuth(c, withUserError(c.hub.ServeWebSockets)))
 
 	r.Route("/v1", func(r chi.Router) {
+		r.Use(c.rateLimiter.limit(RateLimitGroupDefault))
+
+		// streams outlive the request timeout
+		r.Get("/events", withAuth(c, withUserError(c.hub.ServeEvents)))
+		r.Get("/events/poll", withAuth(c, withUserError(c.hub.PollEvents)))
+
+		r = r.With(middleware.Timeout(time.Second * 15))
+
+		strict := r.With(c.rateLimiter.limit(RateLimitGroupStrict))
+
+		r.Post("/events", withAuth(c, withUserError(c.hub.PostEvent)))
+
 		r.Get("/users/{id}/friends", withError(withPagination(c.getFriends)))
 		r.Get("/users/{id}/groups", withError(withPagination(c.getGroups)))
+
+		r.Get("/users/me/devices", withAuth(c, withUserError(c.getDevices)))
+		r.Delete("/users/me/devices/{id}", withAuth(c, withUserError(c.revokeDevice)))
+
+		r.Put("/messages/{id}", withAuth(c, withUserError(c.editMessage)))
+		r.Delete("/messages/{id}", withAuth(c, withUserError(c.deleteMessage)))
+		r.Get("/messages/{id}/edits", withAuth(c, withUserError(c.getMessageEdits)))
+		r.Get("/messages/{id}/thread", withAuth(c, withUserError(withUserPagination(c.getThread))))
+		strict.Put("/messages/{id}/reactions/{emoji}", withAuth(c, withUserError(c.addReaction)))
+		r.Delete("/messages/{id}/reactions/{emoji}", withAuth(c, withUserError(c.removeReaction)))
+		strict.Put("/messages/{id}/pin", withAuth(c, withUserError(c.pinMessage)))
+		r.Delete("/messages/{id}/pin", withAuth(c, withUserError(c.unpinMessage)))
+
+		r.Get("/conversations/{kind}/{id}/messages", withAuth(c, withUserError(withUserPagination(c.getConversationMessages))))
+		r.Get("/conversations/{kind}/{id}/settings", withAuth(c, withUserError(c.getConversationSettings)))
+		r.Put("/conversations/{kind}/{id}/settings", withAuth(c, withUserError(c.updateConversationSettings)))
+		r.Get("/conversations/{kind}/{id}/pins", withAuth(c, withUserError(c.getConversationPins)))
+		r.Put("/conversations/group/{id}/announcement", withAuth(c, withUserError(c.enableAnnouncement)))
+		r.Delete("/conversations/group/{id}/announcement", withAuth(c, withUserError(c.disableAnnouncement)))
+
+		strict.Get("/search/messages", withAuth(c, withUserError(c.searchMessages)))
+
+		strict.Post("/scheduled-messages", withAuth(c, withUserError(c.createScheduledMessage)))
+		r.Get("/scheduled-messages", withAuth(c, withUserError(withUserPagination(c.getScheduledMessages))))
+		r.Delete("/scheduled-messages/{id}", withAuth(c, withUserError(c.cancelScheduledMessage)))
+
+		strict.Post("/attachments", withMaxBytes(c.attachments.maxSize+uploadOverhead, withAuth(c, withUserError(c.uploadAttachment))))
+		r.Get("/attachments/{id}", withAuth(c, withUserError(c.getAttachment)))
+		r.Get("/attachments/{id}/download", withError(c.downloadAttachment))
+		r.Get("/attachments/{id}/thumbnails/{width}/download", withError(c.downloadThumbnail))
 	})
 
 	return r
@@ -0,0 +1,212 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/zerolog/log"
+)
+
+var errScheduledMessageNotFound = errors.New("pending scheduled message not found")
+
+type ScheduledMessageWorkflowState string
+
+const (
+	ScheduledMessageWorkflowStatePending   ScheduledMessageWorkflowState = "pending"
+	ScheduledMessageWorkflowStateSent      ScheduledMessageWorkflowState = "sent"
+	ScheduledMessageWorkflowStateCancelled ScheduledMessageWorkflowState = "cancelled"
+	ScheduledMessageWorkflowStateFailed    ScheduledMessageWorkflowState = "failed"
+)
+
+type ScheduledMessage struct {
+	ID            int64                         `json:"id"`
+	SenderID      int64                         `json:"sender_id"`
+	RecipientID   int64                         `json:"recipient_id"` // user id or group id
+	MessageType   MessageType                   `json:"message_type"`
+	Content       string                        `json:"content"`
+	ReplyToID     null.Int                      `json:"reply_to_id"`
+	AttachmentIDs []int64                       `json:"attachment_ids"`
+	SendAt        time.Time                     `json:"send_at"`
+	WorkflowState ScheduledMessageWorkflowState `json:"workflow_state"`
+	MessageID     null.Int                      `json:"message_id"`
+	Error         null.String                   `json:"error"`
+	CreatedAt     time.Time                     `json:"created_at"`
+}
+
+// message sent when the scheduled message is due
+func (sm ScheduledMessage) message() Message {
+	return Message{
+		SenderID:      sm.SenderID,
+		RecipientID:   sm.RecipientID,
+		MessageType:   sm.MessageType,
+		Content:       sm.Content,
+		ReplyToID:     sm.ReplyToID,
+		AttachmentIDs: sm.AttachmentIDs,
+	}
+}
+
+type ScheduledMessagesRepository interface {
+	createScheduledMessage(ctx context.Context, sm ScheduledMessage) (ScheduledMessage, error)
+	getScheduledMessages(ctx context.Context, pagination Pagination, senderID int64, state ScheduledMessageWorkflowState) ([]ScheduledMessage, error)
+	cancelScheduledMessage(ctx context.Context, id, senderID int64) (ScheduledMessage, error)
+	sendDueScheduledMessages(ctx context.Context, limit int, send func(tx *sql.Tx, sm ScheduledMessage) (Message, error)) (int, error)
+}
+
+type ScheduledMessagesRepositoryPostgreSQL struct {
+	db   *sql.DB
+	pgtm *pgtype.Map
+}
+
+func NewScheduledMessagesRepositoryPostgreSQL(db *sql.DB) *ScheduledMessagesRepositoryPostgreSQL {
+	return &ScheduledMessagesRepositoryPostgreSQL{
+		db:   db,
+		pgtm: pgtype.NewMap(),
+	}
+}
+
+const scheduledMessageColumns = "id, sender_id, recipient_id, message_type, content, reply_to_id, attachment_ids, send_at, workflow_state, message_id, error, created_at"
+
+func (r *ScheduledMessagesRepositoryPostgreSQL) scanScheduledMessage(row rowScanner) (ScheduledMessage, error) {
+	var sm ScheduledMessage
+
+	err := row.Scan(&sm.ID, &sm.SenderID, &sm.RecipientID, &sm.MessageType, &sm.Content, &sm.ReplyToID, r.pgtm.SQLScanner(&sm.AttachmentIDs), &sm.SendAt, &sm.WorkflowState, &sm.MessageID, &sm.Error, &sm.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ScheduledMessage{}, errScheduledMessageNotFound
+	}
+
+	return sm, err
+}
+
+func (r *ScheduledMessagesRepositoryPostgreSQL) scanScheduledMessages(rows *sql.Rows) ([]ScheduledMessage, error) {
+	results := []ScheduledMessage{}
+
+	for rows.Next() {
+		sm, err := r.scanScheduledMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, sm)
+	}
+
+	return results, rows.Err()
+}
+
+func (r *ScheduledMessagesRepositoryPostgreSQL) createScheduledMessage(ctx context.Context, sm ScheduledMessage) (ScheduledMessage, error) {
+	if sm.AttachmentIDs == nil {
+		sm.AttachmentIDs = []int64{}
+	}
+
+	row := r.db.QueryRowContext(ctx,
+		`INSERT INTO scheduled_messages (sender_id, recipient_id, message_type, content, reply_to_id, attachment_ids, send_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+scheduledMessageColumns,
+		sm.SenderID, sm.RecipientID, sm.MessageType, sm.Content, sm.ReplyToID, sm.AttachmentIDs, sm.SendAt,
+	)
+
+	return r.scanScheduledMessage(row)
+}
+
+// returns scheduled messages of the sender in the state, by send time
+func (r *ScheduledMessagesRepositoryPostgreSQL) getScheduledMessages(ctx context.Context, pagination Pagination, senderID int64, state ScheduledMessageWorkflowState) ([]ScheduledMessage, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+scheduledMessageColumns+` FROM scheduled_messages
+		WHERE sender_id = $1 AND workflow_state = $2
+		ORDER BY send_at, id
+		LIMIT $3 OFFSET $4`,
+		senderID, state, pagination.pageSize, pagination.page,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return r.scanScheduledMessages(rows)
+}
+
+// only pending messages can be cancelled, a message being sent is locked until it is sent
+func (r *ScheduledMessagesRepositoryPostgreSQL) cancelScheduledMessage(ctx context.Context, id, senderID int64) (ScheduledMessage, error) {
+	row := r.db.QueryRowContext(ctx,
+		`UPDATE scheduled_messages SET workflow_state = 'cancelled', updated_at = NOW()
+		WHERE id = $1 AND sender_id = $2 AND workflow_state = 'pending'
+		RETURNING `+scheduledMessageColumns,
+		id, senderID,
+	)
+
+	return r.scanScheduledMessage(row)
+}
+
+// claims up to limit due messages and sends them. Rows are locked with SKIP LOCKED until
+// the transaction commits, so replicas running the scheduler never claim the same message.
+// Messages are sent in the transaction claiming them, so a message is sent exactly once.
+// Messages that cannot be sent, e.g. to a group the sender left, are marked failed, those failing
+// on errors of the server stay pending and are retried on the next poll.
+// Returns the number of messages sent or failed.
+func (r *ScheduledMessagesRepositoryPostgreSQL) sendDueScheduledMessages(ctx context.Context, limit int, send func(tx *sql.Tx, sm ScheduledMessage) (Message, error)) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT `+scheduledMessageColumns+` FROM scheduled_messages
+		WHERE workflow_state = 'pending' AND send_at <= NOW()
+		ORDER BY send_at, id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`,
+		limit,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	due, err := r.scanScheduledMessages(rows)
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	done := 0
+
+	for _, sm := range due {
+		// a failed send aborts the statements of the transaction up to the savepoint only
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT scheduled_message`); err != nil {
+			return 0, err
+		}
+
+		message, sendErr := send(tx, sm)
+		if sendErr != nil {
+			if _, err := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT scheduled_message`); err != nil {
+				return 0, err
+			}
+
+			if errorStatus(sendErr) == http.StatusInternalServerError {
+				log.Error().Msg(fmt.Sprintf("send scheduled message %d: %s", sm.ID, sendErr.Error()))
+				continue
+			}
+
+			_, err = tx.ExecContext(ctx,
+				`UPDATE scheduled_messages SET workflow_state = 'failed', error = $2, updated_at = NOW() WHERE id = $1`,
+				sm.ID, sendErr.Error(),
+			)
+		} else {
+			_, err = tx.ExecContext(ctx,
+				`UPDATE scheduled_messages SET workflow_state = 'sent', message_id = $2, updated_at = NOW() WHERE id = $1`,
+				sm.ID, message.ID,
+			)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		done++
+	}
+
+	return done, tx.Commit()
+}
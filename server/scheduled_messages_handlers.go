@@ -0,0 +1,78 @@
+package mig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (c *APIController) createScheduledMessage(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	var req ScheduledMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid request body")
+	}
+
+	result, err := c.scheduler.schedule(context.Background(), u, req)
+	if err != nil {
+		return messageError(err)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusCreated, nil
+}
+
+// query params
+//   - state : 'pending','sent','cancelled','failed' (optional, defaults to pending)
+func (c *APIController) getScheduledMessages(u User, w http.ResponseWriter, r *http.Request, pagination Pagination) (int, error) {
+	state := ScheduledMessageWorkflowState(r.URL.Query().Get("state"))
+
+	if state == "" {
+		state = ScheduledMessageWorkflowStatePending
+	} else if !slices.Contains([]ScheduledMessageWorkflowState{
+		ScheduledMessageWorkflowStatePending,
+		ScheduledMessageWorkflowStateSent,
+		ScheduledMessageWorkflowStateCancelled,
+		ScheduledMessageWorkflowStateFailed,
+	}, state) {
+		return http.StatusBadRequest, fmt.Errorf("invalid state params: %s", state)
+	}
+
+	results, err := c.scheduler.repo.getScheduledMessages(context.Background(), pagination, u.ID, state)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+func (c *APIController) cancelScheduledMessage(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid scheduled message id")
+	}
+
+	result, err := c.scheduler.repo.cancelScheduledMessage(context.Background(), id, u.ID)
+	if err != nil {
+		return messageError(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
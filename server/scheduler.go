@@ -0,0 +1,83 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errInvalidSendAt = errors.New("send_at must be in the future")
+
+// Scheduler stores messages to send later and sends them once due, as if sent live.
+type Scheduler struct {
+	repo      ScheduledMessagesRepository
+	messages  *MessageService
+	interval  time.Duration // time between polls of due messages
+	batchSize int           // due messages claimed per transaction
+}
+
+func NewScheduler(repo ScheduledMessagesRepository, messages *MessageService, interval time.Duration, batchSize int) *Scheduler {
+	return &Scheduler{
+		repo:      repo,
+		messages:  messages,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+func (s *Scheduler) schedule(ctx context.Context, sender User, sm ScheduledMessage) (ScheduledMessage, error) {
+	if sm.MessageType != MessageTypePrivate && sm.MessageType != MessageTypeGroup {
+		return ScheduledMessage{}, errInvalidMessageType
+	}
+
+	if sm.Content == "" && len(sm.AttachmentIDs) == 0 {
+		return ScheduledMessage{}, errEmptyContent
+	}
+
+	if !sm.SendAt.After(time.Now()) {
+		return ScheduledMessage{}, errInvalidSendAt
+	}
+
+	sm.SenderID = sender.ID
+
+	return s.repo.createScheduledMessage(ctx, sm)
+}
+
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sendDue(ctx)
+		}
+	}
+}
+
+// sends due messages in batches until none is left, messages of the batch are left to retry or the context is
+// done. A batch is not canceled once started so that Run returns once its transaction is committed.
+func (s *Scheduler) sendDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		batchCtx := context.WithoutCancel(ctx)
+
+		claimed, err := s.repo.sendDueScheduledMessages(batchCtx, s.batchSize, func(tx *sql.Tx, sm ScheduledMessage) (Message, error) {
+			return s.messages.sendTx(batchCtx, tx, User{ID: sm.SenderID}, sm.message())
+		})
+		if err != nil {
+			msg := fmt.Sprintf("send scheduled messages: %s", err.Error())
+			log.Error().Msg(msg)
+			return
+		}
+
+		if claimed < s.batchSize {
+			return
+		}
+	}
+}
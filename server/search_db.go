@@ -0,0 +1,114 @@
+package mig
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/guregu/null"
+)
+
+// MessageSearch filters a full-text search of the messages a user can read.
+// Results are ordered newest first, BeforeID is the keyset cursor of the next page.
+type MessageSearch struct {
+	Query          string
+	SenderID       null.Int
+	Kind           MessageType // private or group, required with ConversationID
+	ConversationID null.Int    // other user id or group id
+	From           null.Time
+	To             null.Time
+	BeforeID       null.Int
+	Limit          int
+}
+
+type MessageSearchResult struct {
+	Message Message `json:"message"`
+	Snippet string  `json:"snippet"` // HTML escaped fragments of the content, matches wrapped in <mark></mark>
+}
+
+// matches are delimited by control characters, removed from the content, and replaced by <mark> tags once the snippet is escaped
+const searchHeadlineOptions = "StartSel=\x01, StopSel=\x02, MaxFragments=2, MaxWords=20, MinWords=5"
+
+var snippetHighlighter = strings.NewReplacer("\x01", "<mark>", "\x02", "</mark>")
+
+// escapes the content of the headline so clients can render the snippet as HTML
+func highlightSnippet(headline string) string {
+	return snippetHighlighter.Replace(html.EscapeString(headline))
+}
+
+// searches messages of private conversations of the user and of groups the user is an active member of
+func (r *MessagesRepositoryPostgreSQL) searchMessages(ctx context.Context, userID int64, search MessageSearch) ([]MessageSearchResult, error) {
+	args := []any{search.Query, userID}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conditions := []string{
+		"search_vector @@ q",
+		"deleted_at IS NULL",
+		notExpired,
+		`((message_type = 'private' AND (sender_id = $2 OR recipient_id = $2))
+		OR (message_type = 'group' AND recipient_id IN (
+			SELECT group_id FROM group_users WHERE user_id = $2 AND workflow_state = 'active'
+		)))`,
+	}
+
+	if search.SenderID.Valid {
+		conditions = append(conditions, "sender_id = "+arg(search.SenderID.Int64))
+	}
+
+	if search.ConversationID.Valid {
+		switch search.Kind {
+		case MessageTypePrivate:
+			id := arg(search.ConversationID.Int64)
+			conditions = append(conditions, fmt.Sprintf(
+				"message_type = 'private' AND ((sender_id = $2 AND recipient_id = %s) OR (sender_id = %s AND recipient_id = $2))", id, id,
+			))
+		case MessageTypeGroup:
+			conditions = append(conditions, "message_type = 'group' AND recipient_id = "+arg(search.ConversationID.Int64))
+		default:
+			return nil, errInvalidMessageType
+		}
+	}
+
+	if search.From.Valid {
+		conditions = append(conditions, "created_at >= "+arg(search.From.Time))
+	}
+
+	if search.To.Valid {
+		conditions = append(conditions, "created_at < "+arg(search.To.Time))
+	}
+
+	if search.BeforeID.Valid {
+		conditions = append(conditions, "id < "+arg(search.BeforeID.Int64))
+	}
+
+	options := arg(searchHeadlineOptions)
+
+	query := `SELECT ` + messageColumns + `, ts_headline('simple', translate(content, chr(1) || chr(2), ''), q, ` + options + `)
+		FROM messages, websearch_to_tsquery('simple', $1) q
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY id DESC
+		LIMIT ` + arg(search.Limit)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []MessageSearchResult{}
+
+	for rows.Next() {
+		var snippet string
+		m, err := scanMessage(rows, &snippet)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, MessageSearchResult{Message: m, Snippet: highlightSnippet(snippet)})
+	}
+
+	return results, rows.Err()
+}
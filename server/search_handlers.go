@@ -0,0 +1,123 @@
+package mig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/guregu/null"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+type SearchMessagesResponse struct {
+	Results    []MessageSearchResult `json:"results"`
+	NextCursor null.Int              `json:"next_cursor"` // pass as cursor to fetch the next page
+}
+
+// query params
+//   - q : search terms, supports quoted phrases, OR and -exclusions (required)
+//   - sender_id : int64 (optional)
+//   - kind : private or group, and conversation_id : other user id or group id (optional)
+//   - from, to : RFC 3339 date range of the messages (optional)
+//   - cursor : next_cursor of the previous page (optional)
+//   - limit : int, defaults to 20, at most 100 (optional)
+func (c *APIController) searchMessages(u User, w http.ResponseWriter, r *http.Request) (int, error) {
+	query := r.URL.Query()
+
+	search := MessageSearch{
+		Query: query.Get("q"),
+		Kind:  MessageType(query.Get("kind")),
+		Limit: defaultSearchLimit,
+	}
+
+	if search.Query == "" {
+		return http.StatusBadRequest, fmt.Errorf("missing q params")
+	}
+
+	var err error
+
+	if search.SenderID, err = parseOptionalInt(query.Get("sender_id")); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid sender_id params")
+	}
+
+	if search.ConversationID, err = parseOptionalInt(query.Get("conversation_id")); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid conversation_id params")
+	}
+
+	if search.ConversationID.Valid && search.Kind != MessageTypePrivate && search.Kind != MessageTypeGroup {
+		return http.StatusBadRequest, fmt.Errorf("invalid or missing kind params")
+	}
+
+	if search.From, err = parseOptionalTime(query.Get("from")); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid from params")
+	}
+
+	if search.To, err = parseOptionalTime(query.Get("to")); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid to params")
+	}
+
+	if search.BeforeID, err = parseOptionalInt(query.Get("cursor")); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid cursor params")
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		search.Limit, err = strconv.Atoi(limit)
+		if err != nil || search.Limit <= 0 || search.Limit > maxSearchLimit {
+			return http.StatusBadRequest, fmt.Errorf("invalid limit params")
+		}
+	}
+
+	results, err := c.messagesRepo.searchMessages(context.Background(), u.ID, search)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	response := SearchMessagesResponse{
+		Results: results,
+	}
+
+	if len(results) == search.Limit {
+		response.NextCursor = null.IntFrom(results[len(results)-1].Message.ID)
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// empty values are null
+func parseOptionalInt(value string) (null.Int, error) {
+	if value == "" {
+		return null.Int{}, nil
+	}
+
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return null.Int{}, err
+	}
+
+	return null.IntFrom(i), nil
+}
+
+// parses RFC 3339 timestamps, empty values are null
+func parseOptionalTime(value string) (null.Time, error) {
+	if value == "" {
+		return null.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return null.Time{}, err
+	}
+
+	return null.TimeFrom(t), nil
+}
@@ -7,21 +7,36 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 type APIController struct {
-	db         *sql.DB
-	auther     Auther
-	hub        *Hub
-	groupsRepo GroupsRepository
+	db           *sql.DB
+	auther       Auther
+	hub          *Hub
+	groupsRepo   GroupsRepository
+	messagesRepo MessagesRepository
+	messages     *MessageService
+	attachments  *AttachmentService
+	images       *ImageProcessor
+	scheduler    *Scheduler
+	rateLimiter  *HTTPRateLimiter
+	devicesRepo  DevicesRepository
 }
 
-func NewAPIController(db *sql.DB, auther Auther, hub *Hub, groupsRepo GroupsRepository) *APIController {
+func NewAPIController(db *sql.DB, auther Auther, hub *Hub, groupsRepo GroupsRepository, messagesRepo MessagesRepository, messages *MessageService, attachments *AttachmentService, images *ImageProcessor, scheduler *Scheduler, rateLimiter *HTTPRateLimiter, devicesRepo DevicesRepository) *APIController {
 	return &APIController{
-		db:         db,
-		auther:     auther,
-		hub:        hub,
-		groupsRepo: groupsRepo,
+		db:           db,
+		auther:       auther,
+		hub:          hub,
+		groupsRepo:   groupsRepo,
+		messagesRepo: messagesRepo,
+		messages:     messages,
+		attachments:  attachments,
+		images:       images,
+		scheduler:    scheduler,
+		rateLimiter:  rateLimiter,
+		devicesRepo:  devicesRepo,
 	}
 }
 
@@ -61,7 +76,7 @@ func (a *Auther) New(user JWTUser, audience []string) (string, error) {
 			NotBefore: jwt.NewNumericDate(time.Now()),
 			Issuer:    a.issuer,
 			Subject:   fmt.Sprintf("%v", user.id),
-			ID:        fmt.Sprintf("%v", user.id),
+			ID:        uuid.NewString(), // devices connecting with the token are bound to it
 			Audience:  audience,
 		},
 	}
@@ -74,3 +89,17 @@ func (a *Auther) New(user JWTUser, audience []string) (string, error) {
 
 	return ss, nil
 }
+
+// verifies the signature, the issuer and the validity period of the token and returns its claims
+func (a *Auther) Parse(token string) (JWTClaims, error) {
+	claims := JWTClaims{}
+
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		return a.jwtKey, nil
+	}, jwt.WithIssuer(a.issuer), jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return JWTClaims{}, err
+	}
+
+	return claims, nil
+}
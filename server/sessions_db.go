@@ -0,0 +1,152 @@
+package mig
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// Session is a websocket session of a user, resumed on reconnect from the last event it delivered.
+type Session struct {
+	ID          string `json:"id"`
+	LastEventID int64  `json:"last_event_id"`
+}
+
+type SessionsRepository interface {
+	createSession(ctx context.Context, userID int64, ttl time.Duration) (Session, error)
+	getSession(ctx context.Context, id string, userID int64, ttl time.Duration) (Session, error)
+	updateSession(ctx context.Context, id string, lastEventID int64) error
+	getEventsSince(ctx context.Context, userID, since int64, limit int) ([]Event, error)
+	getOldestEventID(ctx context.Context) (int64, error)
+	getLatestEventID(ctx context.Context) (int64, error)
+}
+
+type SessionsRepositoryPostgreSQL struct {
+	db *sql.DB
+}
+
+func NewSessionsRepositoryPostgreSQL(db *sql.DB) *SessionsRepositoryPostgreSQL {
+	return &SessionsRepositoryPostgreSQL{
+		db: db,
+	}
+}
+
+// starts from the latest event published, sessions of the user idle for longer than ttl are deleted
+func (r *SessionsRepositoryPostgreSQL) createSession(ctx context.Context, userID int64, ttl time.Duration) (Session, error) {
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM websocket_sessions WHERE user_id = $1 AND updated_at < $2`, userID, time.Now().Add(-ttl)); err != nil {
+		return Session{}, err
+	}
+
+	s := Session{
+		ID: uuid.NewString(),
+	}
+
+	err := r.db.QueryRowContext(ctx,
+		`INSERT INTO websocket_sessions (id, user_id, last_event_id)
+		VALUES ($1, $2, (SELECT COALESCE(MAX(seq), 0) FROM outbox))
+		RETURNING last_event_id`,
+		s.ID, userID,
+	).Scan(&s.LastEventID)
+
+	return s, err
+}
+
+// returns errSessionNotFound when the session is not one of the user or was idle for longer than ttl
+func (r *SessionsRepositoryPostgreSQL) getSession(ctx context.Context, id string, userID int64, ttl time.Duration) (Session, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return Session{}, errSessionNotFound
+	}
+
+	s := Session{
+		ID: id,
+	}
+
+	err := r.db.QueryRowContext(ctx,
+		`UPDATE websocket_sessions SET updated_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND updated_at >= $3
+		RETURNING last_event_id`,
+		id, userID, time.Now().Add(-ttl),
+	).Scan(&s.LastEventID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, errSessionNotFound
+	}
+
+	return s, err
+}
+
+func (r *SessionsRepositoryPostgreSQL) updateSession(ctx context.Context, id string, lastEventID int64) error {
+	_, err := r.db.ExecContext(ctx,
+		`UPDATE websocket_sessions SET last_event_id = GREATEST(last_event_id, $2), updated_at = NOW() WHERE id = $1`,
+		id, lastEventID,
+	)
+
+	return err
+}
+
+// returns the published events of the user after the given number in the order they were published, at most limit events.
+// The relay is waited for so that the events of the batch it is publishing are returned.
+func (r *SessionsRepositoryPostgreSQL) getEventsSince(ctx context.Context, userID, since int64, limit int) ([]Event, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock_shared(hashtext('outbox'))`); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT seq, payload FROM outbox
+		WHERE seq > $1 AND payload->'recipients' @> to_jsonb($2::BIGINT)
+		ORDER BY seq
+		LIMIT $3`,
+		since, userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var seq int64
+		var payload []byte
+		if err := rows.Scan(&seq, &payload); err != nil {
+			return nil, err
+		}
+
+		var event Event
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		event.ID = seq
+		event.Recipients = nil
+
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// returns the number of the oldest event kept in the outbox, older events were deleted and cannot be replayed
+func (r *SessionsRepositoryPostgreSQL) getOldestEventID(ctx context.Context) (int64, error) {
+	var id int64
+	err := r.db.QueryRowContext(ctx, `SELECT COALESCE(MIN(seq), 0) FROM outbox`).Scan(&id)
+
+	return id, err
+}
+
+// returns the number of the latest event published, clients start from it to receive the events that follow
+func (r *SessionsRepositoryPostgreSQL) getLatestEventID(ctx context.Context) (int64, error) {
+	var id int64
+	err := r.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM outbox`).Scan(&id)
+
+	return id, err
+}
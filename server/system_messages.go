@@ -0,0 +1,26 @@
+package mig
+
+import "github.com/guregu/null"
+
+type SystemEventType string
+
+const (
+	SystemEventTypeMessageTTLChanged   SystemEventType = "message_ttl.changed"
+	SystemEventTypeAnnouncementChanged SystemEventType = "announcement.changed"
+	SystemEventTypeMemberJoined        SystemEventType = "member.joined"
+	SystemEventTypeMemberLeft          SystemEventType = "member.left"
+	SystemEventTypeMemberRemoved       SystemEventType = "member.removed"
+	SystemEventTypeGroupRenamed        SystemEventType = "group.renamed"
+)
+
+// SystemEvent is the structured payload of server generated messages, clients build a localized text from it.
+// Membership and group events are inserted by database triggers, see migrations/000011_system_messages.up.sql.
+type SystemEvent struct {
+	Type              SystemEventType `json:"type"`
+	ActorID           int64           `json:"actor_id"`
+	UserID            null.Int        `json:"user_id,omitempty"` // member who joined, left or was removed
+	MessageTTLSeconds null.Int        `json:"message_ttl_seconds,omitempty"`
+	Announcement      null.Bool       `json:"announcement,omitempty"`
+	Name              null.String     `json:"name,omitempty"`
+	PreviousName      null.String     `json:"previous_name,omitempty"`
+}
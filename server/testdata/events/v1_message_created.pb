@@ -0,0 +1,2 @@
+
+message.createdprivate:1:2"I* *hello2private8)JȔ$0b6f3a4e-7c1d-4a7e-9d1e-2f3c4b5a6d7eX
\ No newline at end of file
@@ -0,0 +1,2 @@
+
+reaction.addedgroup:9**👍"ȔX
\ No newline at end of file
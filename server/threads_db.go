@@ -0,0 +1,60 @@
+package mig
+
+import (
+	"context"
+	"time"
+)
+
+// ThreadSummary aggregates the replies of a thread root message.
+type ThreadSummary struct {
+	ReplyCount  int64
+	LastReplyAt time.Time
+}
+
+// returns replies of the thread, oldest first
+func (r *MessagesRepositoryPostgreSQL) getThreadMessages(ctx context.Context, pagination Pagination, rootID int64) ([]Message, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+messageColumns+` FROM messages
+		WHERE thread_root_id = $1 AND `+notExpired+`
+		ORDER BY id
+		LIMIT $2 OFFSET $3`,
+		rootID, pagination.pageSize, pagination.page,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMessages(rows)
+}
+
+// returns thread summaries keyed by root message id, deleted replies are not counted
+func (r *MessagesRepositoryPostgreSQL) getThreadSummaries(ctx context.Context, rootIDs []int64) (map[int64]ThreadSummary, error) {
+	results := map[int64]ThreadSummary{}
+
+	if len(rootIDs) == 0 {
+		return results, nil
+	}
+
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT thread_root_id, COUNT(*), MAX(created_at) FROM messages
+		WHERE thread_root_id = ANY($1) AND deleted_at IS NULL AND `+notExpired+`
+		GROUP BY thread_root_id`,
+		rootIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rootID int64
+		var ts ThreadSummary
+		if err := rows.Scan(&rootID, &ts.ReplyCount, &ts.LastReplyAt); err != nil {
+			return nil, err
+		}
+		results[rootID] = ts
+	}
+
+	return results, rows.Err()
+}
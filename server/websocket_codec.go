@@ -0,0 +1,105 @@
+package mig
+
+import (
+	"encoding/json"
+	"io"
+	"mig/eventspb"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// subprotocols negotiated with Sec-WebSocket-Protocol, in order of preference.
+// Clients without subprotocol use JSON text frames.
+const (
+	subprotocolProtobuf = "mig.protobuf.v1" // binary frames of eventspb.Event, eventspb.ClientEvent from clients
+	subprotocolJSON     = "mig.json.v1"     // text frames of JSON events, several events of a frame are separated by newlines
+)
+
+var subprotocols = []string{subprotocolProtobuf, subprotocolJSON}
+
+func (c *Client) binary() bool {
+	return c.conn.Subprotocol() == subprotocolProtobuf
+}
+
+func (c *Client) frameType() int {
+	if c.binary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// writes the event in a frame of its own
+func (c *Client) writeEvent(event Event) error {
+	w, err := c.conn.NextWriter(c.frameType())
+	if err != nil {
+		return err
+	}
+
+	if err := c.encode(w, event); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+func (c *Client) encode(w io.Writer, event Event) error {
+	if !c.binary() {
+		return json.NewEncoder(w).Encode(event)
+	}
+
+	data, err := proto.Marshal(eventToProto(event))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+
+	return err
+}
+
+// decodes an event read from a client. JSON payloads without type are a message to send.
+func decodeClientEvent(frameType int, data []byte) (ClientEvent, error) {
+	var event ClientEvent
+
+	if frameType == websocket.BinaryMessage {
+		var pb eventspb.ClientEvent
+		if err := proto.Unmarshal(data, &pb); err != nil {
+			return ClientEvent{}, err
+		}
+
+		return clientEventFromProto(&pb), nil
+	}
+
+	if err := json.Unmarshal(data, &event); err != nil {
+		return ClientEvent{}, err
+	}
+
+	if event.Type == "" {
+		event.Type = ClientEventTypeMessageSend
+		if err := json.Unmarshal(data, &event.Message); err != nil {
+			return ClientEvent{}, err
+		}
+	}
+
+	return event, nil
+}
+
+func clientEventFromProto(pb *eventspb.ClientEvent) ClientEvent {
+	event := ClientEvent{
+		Type: ClientEventType(pb.GetType()),
+	}
+
+	if m := pb.GetMessage(); m != nil {
+		event.Message = messageFromProto(m)
+	}
+
+	if r := pb.GetReaction(); r != nil {
+		event.Reaction = Reaction{
+			MessageID: r.GetMessageId(),
+			Emoji:     r.GetEmoji(),
+		}
+	}
+
+	return event
+}
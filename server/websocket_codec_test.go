@@ -0,0 +1,192 @@
+package mig
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/guregu/null"
+)
+
+// events written to clients in the proportions of a busy group conversation
+func benchmarkEvents() []Event {
+	created := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	message := func(id int64, content string) Event {
+		return Event{
+			ID:              id,
+			Type:            EventTypeMessageCreated,
+			ConversationKey: "group:9",
+			Message: &Message{
+				ID:             id,
+				Sequence:       id,
+				SenderID:       id % 5,
+				RecipientID:    9,
+				Content:        content,
+				MessageType:    MessageTypeGroup,
+				CreatedAt:      created.Add(time.Duration(id) * time.Second),
+				SenderDeviceID: null.StringFrom("0f8fad5b-d9cb-469f-a165-70867728950e"),
+			},
+		}
+	}
+
+	return []Event{
+		message(1, "are we still on for the release review this afternoon?"),
+		{Type: EventTypeTyping, ConversationKey: "group:9", Presence: &Presence{UserID: 2, Status: "online"}},
+		message(2, "yes, 3pm. I moved the notes to the shared doc, have a look at the rollout section before"),
+		{ID: 3, Type: EventTypeReactionAdded, ConversationKey: "group:9", Reaction: &Reaction{MessageID: 2, UserID: 1, Emoji: "👍", CreatedAt: created}},
+		{ID: 4, Type: EventTypeReceiptUpdated, ConversationKey: "group:9", Receipt: &Receipt{MessageID: 2, UserID: 3, Status: "read", CreatedAt: created}},
+		message(5, "ok"),
+		{Type: EventTypePresenceUpdated, Presence: &Presence{UserID: 4, Status: "offline", LastSeenAt: null.TimeFrom(created)}},
+		message(6, strings.Repeat("the canary failed on the eu cluster, rolling back and collecting logs. ", 4)),
+	}
+}
+
+// counts the bytes read from the connection, frame headers included
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// returns a server client of a websocket connection negotiating the subprotocol and the compression, the
+// bytes on the wire and the frames read by the peer
+func benchmarkClient(b *testing.B, subprotocol string, compression bool) (*Client, *atomic.Int64, *atomic.Int64) {
+	b.Helper()
+
+	conns := make(chan *websocket.Conn, 1)
+
+	upgrader := websocket.Upgrader{
+		Subprotocols:      subprotocols,
+		EnableCompression: compression,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	b.Cleanup(server.Close)
+
+	wire := &atomic.Int64{}
+	frames := &atomic.Int64{}
+
+	dialer := websocket.Dialer{
+		Subprotocols:      []string{subprotocol},
+		EnableCompression: compression,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return &countingConn{Conn: conn, read: wire}, err
+		},
+	}
+
+	peer, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { peer.Close() })
+
+	// the handshake is not counted
+	wire.Store(0)
+
+	go func() {
+		for {
+			if _, _, err := peer.ReadMessage(); err != nil {
+				return
+			}
+			frames.Add(1)
+		}
+	}()
+
+	conn := <-conns
+	b.Cleanup(func() { conn.Close() })
+
+	if conn.Subprotocol() != subprotocol {
+		b.Fatalf("negotiated subprotocol %q, want %q", conn.Subprotocol(), subprotocol)
+	}
+
+	return &Client{conn: conn}, wire, frames
+}
+
+// writes representative events in frames of their own and reports the bytes on the wire per frame
+func BenchmarkWriteEvent(b *testing.B) {
+	events := benchmarkEvents()
+
+	for _, bm := range []struct {
+		name        string
+		subprotocol string
+		compression bool
+	}{
+		{"json", subprotocolJSON, false},
+		{"json-deflate", subprotocolJSON, true},
+		{"protobuf", subprotocolProtobuf, false},
+		{"protobuf-deflate", subprotocolProtobuf, true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			client, wire, frames := benchmarkClient(b, bm.subprotocol, bm.compression)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := client.writeEvent(events[i%len(events)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.StopTimer()
+
+			for frames.Load() < int64(b.N) {
+				time.Sleep(time.Millisecond)
+			}
+
+			b.ReportMetric(float64(wire.Load())/float64(b.N), "wire-B/frame")
+		})
+	}
+}
+
+// encodes representative events without connection, the cost of the codecs alone
+func BenchmarkEncodeEvent(b *testing.B) {
+	events := benchmarkEvents()
+
+	for _, bm := range []struct {
+		name        string
+		subprotocol string
+	}{
+		{"json", subprotocolJSON},
+		{"protobuf", subprotocolProtobuf},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			client, _, _ := benchmarkClient(b, bm.subprotocol, false)
+
+			var buf strings.Builder
+			size := 0
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := client.encode(&buf, events[i%len(events)]); err != nil {
+					b.Fatal(err)
+				}
+				size += buf.Len()
+			}
+
+			b.ReportMetric(float64(size)/float64(b.N), "B/event")
+		})
+	}
+}
@@ -3,96 +3,477 @@ package mig
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"net/http"
 	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/guregu/null"
 	"github.com/rs/zerolog/log"
 )
 
 // Reference - https://github.com/gorilla/websocket/blob/main/examples/chat/Client.go
 
 const (
-	writeWait      = 10 * time.Second    // time allowed to write a message to the connection
-	pongWait       = 60 * time.Second    // time allowed to read the next pong message from the connection
-	pingPeriod     = (pongWait * 9) / 10 // time interval for sending ping message to the connection
-	maxMessageSize = 512                 // maxmimum message size allowed from connection
+	writeWait  = 10 * time.Second    // time allowed to write a message to the connection
+	pongWait   = 60 * time.Second    // time allowed to read the next pong message from the connection
+	pingPeriod = (pongWait * 9) / 10 // time interval for sending ping message to the connection
+	hubShards  = 64                  // shards of the client registry, users are spread by id
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+var errServerShuttingDown = errors.New("server is shutting down, reconnect to another server")
+
+// WebSocketTransport configures the frames of websocket connections.
+// Write buffers are pooled between connections, they are only held while a frame is written. Read buffers
+// are kept by each connection instead: its reader waits in a read for the next frame from the client, so it
+// would hold a pooled buffer all along. They are kept small, frames larger than the buffer take several reads.
+type WebSocketTransport struct {
+	ReadLimit        int64 // maximum size of a frame read from a connection
+	ReadBufferSize   int
+	WriteBufferSize  int
+	Compression      bool // permessage-deflate is used when the client offers it
+	CompressionLevel int  // flate level from 1 (fastest) to 9 (smallest)
 }
 
+// events queued on clients, events dropped or clients disconnected by overflow policy and
+// rate limited events by class, served with the other expvar metrics on the metrics listener
+var (
+	wsQueuedEvents = expvar.NewInt("mig_ws_queued_events")
+	wsOverflows    = expvar.NewMap("mig_ws_queue_overflows")
+	wsRateLimited  = expvar.NewMap("mig_ws_rate_limited_events")
+)
+
+// OverflowPolicy decides what happens to an event delivered to a client whose send queue is full.
+type OverflowPolicy string
+
+const (
+	OverflowDropOldest OverflowPolicy = "drop_oldest" // the oldest queued event is dropped
+	OverflowDisconnect OverflowPolicy = "disconnect"  // the client is disconnected, it reconnects and fetches the history
+	OverflowInbox      OverflowPolicy = "inbox"       // the event is dropped, events are persisted and the client is told to resync once its queue drains
+)
+
 type Client struct {
 	hub     *Hub
 	user    User
 	conn    *websocket.Conn
-	message chan Message
+	message chan Event
+	done    chan struct{}          // closed when the client is unregistered
+	closing atomic.Pointer[[]byte] // close frame written when the client is unregistered by the server
+	behind  atomic.Bool            // events were dropped since the last resync
+	flush   atomic.Bool            // queued events are written before the close frame
+
+	buckets    map[rateClass]*tokenBucket // rate limits of the connection
+	violations int                        // rate limited events since the last allowed one
+
+	session     string       // id of the websocket session, resumed on reconnect
+	replayed    int64        // id of the last event replayed on resume, live events up to it are duplicates
+	lastEventID atomic.Int64 // id of the last event delivered on the session
 }
 
+type ClientEventType string
+
+const (
+	ClientEventTypeMessageSend    ClientEventType = "message.send"
+	ClientEventTypeMessageEdit    ClientEventType = "message.edit"
+	ClientEventTypeMessageDelete  ClientEventType = "message.delete"
+	ClientEventTypeReactionAdd    ClientEventType = "reaction.add"
+	ClientEventTypeReactionRemove ClientEventType = "reaction.remove"
+)
+
+type rateClass string
+
+const (
+	rateClassMessages rateClass = "messages" // messages sent, edited or deleted
+	rateClassEvents   rateClass = "events"   // reactions and ephemeral events such as typing and presence
+)
+
+func (t ClientEventType) rateClass() rateClass {
+	switch t {
+	case "", ClientEventTypeMessageSend, ClientEventTypeMessageEdit, ClientEventTypeMessageDelete:
+		return rateClassMessages
+	default:
+		return rateClassEvents
+	}
+}
+
+// WebSocketRateLimits are the token buckets of events read from websocket connections. User limits are
+// kept in the store, shared by the connections of the user on every server. Connections are closed after
+// MaxViolations rate limited events in a row.
+type WebSocketRateLimits struct {
+	Store         RateLimitStore
+	Messages      RateLimit
+	Events        RateLimit
+	UserMessages  RateLimit
+	UserEvents    RateLimit
+	MaxViolations int
+}
+
+func (l WebSocketRateLimits) connection(class rateClass) RateLimit {
+	if class == rateClassMessages {
+		return l.Messages
+	}
+	return l.Events
+}
+
+func (l WebSocketRateLimits) user(class rateClass) RateLimit {
+	if class == rateClassMessages {
+		return l.UserMessages
+	}
+	return l.UserEvents
+}
+
+// ClientEvent is the JSON payload read from websocket connections.
+// Payloads without type are handled as a message to send.
+type ClientEvent struct {
+	Type     ClientEventType `json:"type"`
+	Message  Message         `json:"message"`
+	Reaction Reaction        `json:"reaction"`
+}
+
+// Hub keeps the connected clients of every user. The registry is split in shards with their own lock
+// so that connections of different users and deliveries from broker consumers do not contend.
 type Hub struct {
-	broker     MessageBroker
-	clients    map[int64][]*Client
-	register   chan *Client
-	unregister chan *Client
+	messages   *MessageService
+	sessions   SessionsRepository
+	devices    DevicesRepository
+	shards     [hubShards]hubShard
+	queueSize  int            // events queued per client before the overflow policy applies
+	overflow   OverflowPolicy // policy of clients with a full queue
+	writeBatch int            // queued events coalesced in a frame, separated by newlines
+
+	replayLimit int           // events replayed on resume, clients further behind are told to resync
+	sessionTTL  time.Duration // time a session can be resumed after its last connection
+	rateLimits  WebSocketRateLimits
+	transport   WebSocketTransport
+	upgrader    websocket.Upgrader
+
+	draining atomic.Bool    // new connections are refused once the hub shuts down
+	writers  sync.WaitGroup // writers of the connected clients
+}
+
+type hubShard struct {
+	mu      sync.RWMutex
+	clients map[int64][]*Client
 }
 
-func NewHub(broker MessageBroker) *Hub {
-	return &Hub{
-		broker:     broker,
-		clients:    make(map[int64][]*Client),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+func NewHub(messages *MessageService, sessions SessionsRepository, devices DevicesRepository, queueSize int, overflow OverflowPolicy, writeBatch, replayLimit int, sessionTTL time.Duration, rateLimits WebSocketRateLimits, transport WebSocketTransport) (*Hub, error) {
+	switch overflow {
+	case OverflowDropOldest, OverflowDisconnect, OverflowInbox:
+	default:
+		return nil, fmt.Errorf("unrecognized overflow policy: %s", overflow)
 	}
+
+	hub := &Hub{
+		messages:    messages,
+		sessions:    sessions,
+		devices:     devices,
+		queueSize:   queueSize,
+		overflow:    overflow,
+		writeBatch:  max(writeBatch, 1),
+		replayLimit: replayLimit,
+		sessionTTL:  sessionTTL,
+		rateLimits:  rateLimits,
+		transport:   transport,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:    transport.ReadBufferSize,
+			WriteBufferSize:   transport.WriteBufferSize,
+			WriteBufferPool:   &sync.Pool{},
+			Subprotocols:      subprotocols,
+			EnableCompression: transport.Compression,
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+	}
+
+	for i := range hub.shards {
+		hub.shards[i].clients = make(map[int64][]*Client)
+	}
+
+	return hub, nil
 }
 
-func (h *Hub) Run(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case client := <-h.register:
-			h.clients[client.user.ID] = append(h.clients[client.user.ID], client)
-		case client := <-h.unregister:
-			if _, ok := h.clients[client.user.ID]; ok {
-				h.clients[client.user.ID] = slices.DeleteFunc(h.clients[client.user.ID], func(c *Client) bool {
-					return client == c
-				})
-
-				if len(h.clients[client.user.ID]) == 0 {
-					delete(h.clients, client.user.ID)
-				}
+func (h *Hub) shard(userID int64) *hubShard {
+	return &h.shards[uint64(userID)%hubShards]
+}
 
-				close(client.message)
-			}
+// returns false when the hub is shutting down. A registered client counts as a writer of the hub until its
+// writer calls writers.Done, so that Shutdown waits for clients registered while it starts.
+func (h *Hub) register(client *Client) bool {
+	shard := h.shard(client.user.ID)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if h.draining.Load() {
+		return false
+	}
+
+	shard.clients[client.user.ID] = append(shard.clients[client.user.ID], client)
+	h.writers.Add(1)
+
+	return true
+}
+
+// removes the client from the registry, unregistering a client twice has no effect
+func (h *Hub) unregister(client *Client) {
+	shard := h.shard(client.user.ID)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	clients, ok := shard.clients[client.user.ID]
+	if !ok || !slices.Contains(clients, client) {
+		return
+	}
+
+	clients = slices.DeleteFunc(clients, func(c *Client) bool {
+		return client == c
+	})
+
+	if len(clients) == 0 {
+		delete(shard.clients, client.user.ID)
+	} else {
+		shard.clients[client.user.ID] = clients
+	}
+
+	close(client.done)
+}
+
+// returns a copy of the connected clients of the user, safe to use without holding the lock
+func (h *Hub) clients(userID int64) []*Client {
+	shard := h.shard(userID)
+
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	return slices.Clone(shard.clients[userID])
+}
+
+// Shutdown refuses new connections, then closes the connected clients with a close frame telling them to
+// reconnect to another server once their queued events are written. It waits for the writers until the context is done.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.draining.Store(true)
+
+	clients := []*Client{}
+	for i := range h.shards {
+		shard := &h.shards[i]
+
+		shard.mu.RLock()
+		for _, userClients := range shard.clients {
+			clients = append(clients, userClients...)
 		}
+		shard.mu.RUnlock()
+	}
+
+	log.Info().Msg(fmt.Sprintf("closing %d websocket connections...", len(clients)))
+
+	for _, client := range clients {
+		client.flush.Store(true)
+		client.close(websocket.CloseServiceRestart, "reconnect elsewhere")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		h.writers.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (h *Hub) ServeWebSockets(user User, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// Deliver writes the event to the connected clients of the user.
+// Clients unregistered during the delivery are skipped.
+func (h *Hub) Deliver(userID int64, event Event) {
+	for _, client := range h.clients(userID) {
+		client.send(event)
+	}
+}
 
+// upgrades the request to a websocket connection. Clients reconnecting with resume=<session>&since=<event id>
+// get the events they missed before live events, since defaults to the last event delivered on the session.
+// The device of the connection is registered from device=<id>&platform=<platform>&name=<name> once the
+// connection is upgraded, a new device is created without id unless the access token is bound to one.
+func (h *Hub) ServeWebSockets(user User, w http.ResponseWriter, r *http.Request) (int, error) {
+	if h.draining.Load() {
+		return http.StatusServiceUnavailable, errServerShuttingDown
+	}
+
+	device := Device{
+		ID:       r.URL.Query().Get("device"),
+		UserID:   user.ID,
+		Platform: r.URL.Query().Get("platform"),
+		Name:     r.URL.Query().Get("name"),
+	}
+	if device.Platform == "" {
+		device.Platform = "web"
+	}
+	if len(device.Platform) > 32 || len(device.Name) > 255 {
+		return messageError(errInvalidDevice)
+	}
+
+	var since null.Int
+	if s := r.URL.Query().Get("since"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id < 0 {
+			return http.StatusBadRequest, fmt.Errorf("invalid since: %s", s)
+		}
+		since = null.IntFrom(id)
+	}
+
+	resume := r.URL.Query().Get("resume")
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		// the upgrader replied to the request
 		log.Error().Msg(err.Error())
-		return
+		return 0, nil
 	}
 
-	client := &Client{
+	// requests that are not upgraded register no device nor session
+	device, err = h.devices.registerDevice(r.Context(), device, user.TokenID)
+	if err != nil {
+		closeRefused(conn, fmt.Errorf("register device: %w", err))
+		return 0, nil
+	}
+	user.DeviceID = device.ID
+
+	session, resumed, err := h.session(r.Context(), user.ID, resume)
+	if err != nil {
+		closeRefused(conn, fmt.Errorf("session: %w", err))
+		return 0, nil
+	}
+
+	if h.transport.Compression {
+		if err := conn.SetCompressionLevel(h.transport.CompressionLevel); err != nil {
+			log.Error().Msg(fmt.Sprintf("compression level: %s", err.Error()))
+		}
+	}
+
+	client := h.newClient(user, conn)
+	client.session = session.ID
+	client.lastEventID.Store(session.LastEventID)
+
+	// live events are queued during the replay
+	if !client.hub.register(client) {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, "reconnect elsewhere"), time.Now().Add(writeWait))
+		conn.Close()
+		return 0, nil
+	}
+
+	// a session that cannot be resumed was replaced by a new one
+	expired := resume != "" && !resumed
+
+	if err := client.replay(r.Context(), session, device, resumed, expired, since); err != nil {
+		log.Error().Msg(fmt.Sprintf("replay session %s: %s", session.ID, err.Error()))
+		client.hub.unregister(client)
+		client.hub.writers.Done()
+		conn.Close()
+		return 0, nil
+	}
+
+	go client.read()
+	go client.write()
+
+	return 0, nil
+}
+
+// closes an upgraded connection that cannot be served with a close frame telling why, the status of the
+// error cannot be written anymore. Internal errors are logged instead of written.
+func closeRefused(conn *websocket.Conn, err error) {
+	code, text := websocket.ClosePolicyViolation, errors.Unwrap(err).Error()
+	if errorStatus(err) == http.StatusInternalServerError {
+		log.Error().Msg(err.Error())
+		code, text = websocket.CloseInternalServerErr, http.StatusText(http.StatusInternalServerError)
+	}
+
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(writeWait))
+	conn.Close()
+}
+
+// returns a client of the user, conn is nil for clients of the HTTP fallbacks which read the queue themselves
+func (h *Hub) newClient(user User, conn *websocket.Conn) *Client {
+	return &Client{
 		hub:     h,
 		user:    user,
 		conn:    conn,
-		message: make(chan Message),
+		message: make(chan Event, h.queueSize),
+		done:    make(chan struct{}),
+		buckets: make(map[rateClass]*tokenBucket),
 	}
+}
 
-	client.hub.register <- client
+// returns the session to resume or a new session when there is none, resumed is false for new sessions
+func (h *Hub) session(ctx context.Context, userID int64, id string) (Session, bool, error) {
+	if id != "" {
+		session, err := h.sessions.getSession(ctx, id, userID, h.sessionTTL)
+		if err == nil {
+			return session, true, nil
+		}
+		if !errors.Is(err, errSessionNotFound) {
+			return Session{}, false, err
+		}
+	}
 
-	go client.read()
-	go client.write()
+	session, err := h.sessions.createSession(ctx, userID, h.sessionTTL)
+
+	return session, false, err
+}
+
+// writes the event to the connected clients of every recipient
+func (h *Hub) deliver(event Event) {
+	recipients := event.Recipients
+	event.Recipients = nil
+
+	for _, userID := range recipients {
+		h.Deliver(userID, event)
+
+		if event.Type == EventTypeDeviceRevoked && event.Device != nil {
+			h.closeDevice(userID, event.Device.ID)
+		}
+	}
+}
+
+// closes the connections of the device, once the revocation is written to them
+func (h *Hub) closeDevice(userID int64, deviceID string) {
+	for _, client := range h.clients(userID) {
+		if client.user.DeviceID == deviceID {
+			client.flush.Store(true)
+			client.close(websocket.ClosePolicyViolation, "device revoked")
+		}
+	}
+}
+
+// delivery panics are returned as errors so that broker consumers keep running.
+// Recipients of legacy records, published without them, are resolved from their message.
+func deliverEvent(hub *Hub, event Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("deliver: %v", r)
+		}
+	}()
+
+	if len(event.Recipients) == 0 && event.Message != nil {
+		event.Recipients, err = hub.messages.recipients(context.Background(), *event.Message)
+		if err != nil {
+			return fmt.Errorf("recipients: %w", err)
+		}
+	}
+
+	hub.deliver(event)
+
+	return nil
 }
 
 func handleKafkaMsgReceived(msg []byte) error {
@@ -106,11 +487,11 @@ func handleKafkaMsgReceived(msg []byte) error {
 // reads pong message and JSON payload from websocket connection
 func (c *Client) read() {
 	defer func() {
-		c.hub.unregister <- c
+		c.hub.unregister(c)
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadLimit(c.hub.transport.ReadLimit)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -118,7 +499,7 @@ func (c *Client) read() {
 	})
 
 	for {
-		_, msg, err := c.conn.ReadMessage()
+		frameType, msg, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Error().Msg(err.Error())
@@ -127,17 +508,278 @@ func (c *Client) read() {
 			break
 		}
 
-		var payload Message
-		if err := json.Unmarshal(msg, &payload); err != nil {
-			log.Error().Msg(err.Error())
+		payload, parseErr := decodeClientEvent(frameType, msg)
+
+		if !c.allow(payload.Type) {
+			if maxViolations := c.hub.rateLimits.MaxViolations; maxViolations > 0 && c.violations >= maxViolations {
+				c.close(websocket.ClosePolicyViolation, "rate limit exceeded")
+				break
+			}
+			continue
+		}
+
+		if parseErr != nil {
+			log.Error().Msg(parseErr.Error())
+
+			c.send(Event{
+				Type:  EventTypeError,
+				Error: &ErrorResponse{Code: "00001", Message: "JSON failed, please contact IT."},
+			})
+
+			continue
+		}
+
+		if _, err := c.hub.handle(context.Background(), c.user, payload); err != nil {
+			c.send(errorEvent(err))
+		}
+	}
+}
+
+// returns false when the event exceeds a limit of the connection or the user, the client is told when to retry.
+// Limits are not enforced when the store fails.
+func (c *Client) allow(eventType ClientEventType) bool {
+	class := eventType.rateClass()
+	limits := c.hub.rateLimits
+
+	bucket, ok := c.buckets[class]
+	if !ok {
+		bucket = &tokenBucket{}
+		c.buckets[class] = bucket
+	}
+
+	var retryAfter time.Duration
+
+	if limit := limits.connection(class); limit.enabled() {
+		if result := bucket.take(limit, time.Now()); !result.Allowed {
+			retryAfter = result.RetryAfter
+		}
+	}
+
+	if limit := limits.user(class); retryAfter == 0 && limit.enabled() && limits.Store != nil {
+		key := fmt.Sprintf("ws:%s:user:%d", class, c.user.ID)
+
+		result, err := limits.Store.take(context.Background(), key, limit)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("rate limit %s: %s", key, err.Error()))
+		} else if !result.Allowed {
+			retryAfter = result.RetryAfter
+		}
+	}
+
+	if retryAfter == 0 {
+		c.violations = 0
+		return true
+	}
+
+	c.violations++
+	wsRateLimited.Add(string(class), 1)
+
+	c.send(Event{
+		Type: EventTypeRateLimited,
+		Error: &ErrorResponse{
+			Code:       fmt.Sprintf("%d", http.StatusTooManyRequests),
+			Message:    fmt.Sprintf("too many %s, retry later", class),
+			RetryAfter: seconds(retryAfter),
+		},
+	})
+
+	return false
+}
+
+// handles an event of a client of any transport, returns the message or reaction changed
+func (h *Hub) handle(ctx context.Context, user User, event ClientEvent) (any, error) {
+	switch event.Type {
+	case ClientEventTypeMessageSend:
+		return h.messages.send(ctx, user, event.Message)
+	case ClientEventTypeMessageEdit:
+		return h.messages.edit(ctx, user, event.Message.ID, event.Message.Content)
+	case ClientEventTypeMessageDelete:
+		return h.messages.delete(ctx, user, event.Message.ID)
+	case ClientEventTypeReactionAdd:
+		return h.messages.addReaction(ctx, user, event.Reaction.MessageID, event.Reaction.Emoji)
+	case ClientEventTypeReactionRemove:
+		return h.messages.removeReaction(ctx, user, event.Reaction.MessageID, event.Reaction.Emoji)
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnrecognizedEventType, event.Type)
+	}
+}
+
+// converts the error to an event written back to the client, internal errors are logged and hidden
+func errorEvent(err error) Event {
+	code := errorStatus(err)
+
+	errResponse := ErrorResponse{
+		Code:    fmt.Sprintf("%d", code),
+		Message: err.Error(),
+	}
+
+	if code == http.StatusInternalServerError {
+		log.Error().Msg(err.Error())
+		errResponse.Message = http.StatusText(http.StatusInternalServerError)
+	}
+
+	return Event{
+		Type:  EventTypeError,
+		Error: &errResponse,
+	}
+}
+
+// writes the session with the device of the connection and the events missed since the given id, before the writer starts.
+// Clients reconnecting with an expired session or missing more than replayLimit events are told to resync.
+func (c *Client) replay(ctx context.Context, session Session, device Device, resumed, expired bool, since null.Int) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.writeEvent(Event{Type: EventTypeSession, Session: &session, Device: &device}); err != nil {
+		return err
+	}
+
+	if expired {
+		return c.writeEvent(Event{Type: EventTypeResync})
+	}
+
+	if !resumed {
+		return nil
+	}
+
+	from := session.LastEventID
+	if since.Valid {
+		from = since.Int64
+	}
+
+	events, ok, err := c.hub.missedEvents(ctx, c.user.ID, from)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return c.writeEvent(Event{Type: EventTypeResync})
+	}
+
+	for _, event := range events {
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.writeEvent(event); err != nil {
+			return err
+		}
+
+		c.replayed = event.ID
+		if event.ID > c.lastEventID.Load() {
+			c.lastEventID.Store(event.ID)
+		}
+	}
+
+	return nil
+}
+
+// returns the events of the user published after the given id, ok is false when they cannot be replayed
+// because they were deleted from the outbox or are more than replayLimit
+func (h *Hub) missedEvents(ctx context.Context, userID, since int64) ([]Event, bool, error) {
+	oldest, err := h.sessions.getOldestEventID(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if since+1 < oldest {
+		return nil, false, nil
+	}
+
+	events, err := h.sessions.getEventsSince(ctx, userID, since, h.replayLimit+1)
+	if err != nil {
+		return nil, false, err
+	}
 
-			c.conn.WriteMessage(websocket.TextMessage, []byte(`{"code":"00001","message":"JSON failed, please contact IT."}`))
+	if len(events) > h.replayLimit {
+		return nil, false, nil
+	}
+
+	return events, true, nil
+}
 
+// returns false for events already replayed on the session, keeps track of the last event delivered
+func (c *Client) fresh(event Event) bool {
+	if event.ID == 0 {
+		return true
+	}
+
+	if event.ID <= c.replayed {
+		return false
+	}
+
+	if event.ID > c.lastEventID.Load() {
+		c.lastEventID.Store(event.ID)
+	}
+
+	return true
+}
+
+// queues the event for the writer without blocking, the overflow policy of the hub applies when the queue is full.
+// Events sent after the client is unregistered are dropped.
+func (c *Client) send(event Event) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case c.message <- event:
+			wsQueuedEvents.Add(1)
+			return
+		default:
+		}
+
+		wsOverflows.Add(string(c.hub.overflow), 1)
+
+		switch c.hub.overflow {
+		case OverflowDropOldest:
+			select {
+			case <-c.message:
+				wsQueuedEvents.Add(-1)
+			default:
+			}
+		case OverflowDisconnect:
+			c.close(websocket.CloseTryAgainLater, "send queue overflow")
+			return
+		case OverflowInbox:
+			c.behind.Store(true)
+			return
+		}
+	}
+}
+
+// unregisters the client, the writer sends the close frame and closes the connection
+func (c *Client) close(code int, text string) {
+	msg := websocket.FormatCloseMessage(code, text)
+	c.closing.CompareAndSwap(nil, &msg)
+	c.hub.unregister(c)
+}
+
+// writes the event and up to writeBatch - 1 queued events in a frame, separated by newlines.
+// Binary frames hold a single event.
+func (c *Client) writeBatch(event Event) error {
+	if c.binary() {
+		return c.writeEvent(event)
+	}
+
+	w, err := c.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(event); err != nil {
+		return err
+	}
+
+	for i := 1; i < c.hub.writeBatch && len(c.message) > 0; i++ {
+		event := <-c.message
+		wsQueuedEvents.Add(-1)
+
+		if !c.fresh(event) {
 			continue
 		}
 
-		c.hub.broker.publish("mig.messages.created", payload)
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
 	}
+
+	return w.Close()
 }
 
 // writes ping message and JSON payload on websocket connection
@@ -147,21 +789,65 @@ func (c *Client) write() {
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.hub.writers.Done()
+
+		if err := c.hub.sessions.updateSession(context.Background(), c.session, c.lastEventID.Load()); err != nil {
+			log.Error().Msg(fmt.Sprintf("update session %s: %s", c.session, err.Error()))
+		}
+
+		if err := c.hub.devices.touchDevice(context.Background(), c.user.DeviceID); err != nil {
+			log.Error().Msg(fmt.Sprintf("update device %s: %s", c.user.DeviceID, err.Error()))
+		}
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.message:
+		case <-c.done:
+			if c.flush.Load() {
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				for len(c.message) > 0 {
+					message := <-c.message
+					wsQueuedEvents.Add(-1)
+
+					if !c.fresh(message) {
+						continue
+					}
+
+					if err := c.writeBatch(message); err != nil {
+						break
+					}
+				}
+			}
+
+			wsQueuedEvents.Add(-int64(len(c.message)))
+
+			msg := []byte{}
+			if closing := c.closing.Load(); closing != nil {
+				msg = *closing
+			}
+
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+			c.conn.WriteMessage(websocket.CloseMessage, msg)
+			return
+
+		case message := <-c.message:
+			wsQueuedEvents.Add(-1)
+
+			if !c.fresh(message) {
+				continue
 			}
 
-			if err := c.conn.WriteJSON(message); err != nil {
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.writeBatch(message); err != nil {
 				return
 			}
 
+			if len(c.message) == 0 && c.behind.CompareAndSwap(true, false) {
+				if err := c.writeEvent(Event{Type: EventTypeResync}); err != nil {
+					return
+				}
+			}
+
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
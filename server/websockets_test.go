@@ -0,0 +1,317 @@
+package mig
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+)
+
+func newTestHub(tb testing.TB, queueSize int, overflow OverflowPolicy) *Hub {
+	tb.Helper()
+
+	hub, err := NewHub(nil, nil, nil, queueSize, overflow, 1, 100, time.Hour, WebSocketRateLimits{}, WebSocketTransport{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return hub
+}
+
+// registers a client of the user read by a writer until it is unregistered, like the HTTP fallbacks.
+// Returns the client and a channel of the events it read.
+func (h *Hub) testClient(tb testing.TB, userID int64) (*Client, <-chan Event) {
+	tb.Helper()
+
+	client := h.newClient(User{ID: userID}, nil)
+	if !h.register(client) {
+		tb.Fatal("client refused")
+	}
+
+	events := make(chan Event, h.queueSize)
+
+	go func() {
+		defer h.writers.Done()
+		defer close(events)
+
+		for {
+			select {
+			case <-client.done:
+				return
+			case event := <-client.message:
+				wsQueuedEvents.Add(-1)
+
+				select {
+				case events <- event:
+				default:
+				}
+			}
+		}
+	}()
+
+	return client, events
+}
+
+func TestHubDeliver(t *testing.T) {
+	hub := newTestHub(t, 16, OverflowDropOldest)
+
+	_, first := hub.testClient(t, 1)
+	_, second := hub.testClient(t, 1)
+	_, other := hub.testClient(t, 2)
+
+	hub.deliver(Event{ID: 1, Type: EventTypeMessageCreated, Recipients: []int64{1}})
+
+	for _, events := range []<-chan Event{first, second} {
+		select {
+		case event := <-events:
+			if event.ID != 1 || event.Recipients != nil {
+				t.Errorf("got event %+v, want event 1 without recipients", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("event not delivered to a client of the recipient")
+		}
+	}
+
+	select {
+	case event := <-other:
+		t.Errorf("event %d delivered to another user", event.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHubUnregister(t *testing.T) {
+	hub := newTestHub(t, 1, OverflowDropOldest)
+
+	client := hub.newClient(User{ID: 1}, nil)
+	if !hub.register(client) {
+		t.Fatal("client refused")
+	}
+
+	hub.unregister(client)
+	hub.unregister(client)
+
+	if clients := hub.clients(1); len(clients) != 0 {
+		t.Errorf("%d clients registered after unregister", len(clients))
+	}
+
+	// events sent to an unregistered client are dropped without blocking
+	client.send(Event{ID: 1})
+	client.send(Event{ID: 2})
+}
+
+// registers, unregisters and delivers to clients of the same users from many goroutines, then shuts down
+// while deliveries continue. Run with -race.
+func TestHubConcurrency(t *testing.T) {
+	hub := newTestHub(t, 8, OverflowDropOldest)
+
+	const users = 50
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+
+			random := rand.New(rand.NewSource(seed))
+			connected := []*Client{}
+
+			for ctx.Err() == nil {
+				client := hub.newClient(User{ID: random.Int63n(users)}, nil)
+				if !hub.register(client) {
+					return
+				}
+
+				go func() {
+					defer hub.writers.Done()
+
+					for {
+						select {
+						case <-client.done:
+							return
+						case <-client.message:
+							wsQueuedEvents.Add(-1)
+						}
+					}
+				}()
+
+				// a hundred clients stay connected per goroutine
+				connected = append(connected, client)
+				if len(connected) > 100 {
+					i := random.Intn(len(connected))
+					connected[i].close(1000, "")
+					connected = slices.Delete(connected, i, i+1)
+				}
+			}
+		}(int64(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+
+			random := rand.New(rand.NewSource(seed))
+
+			for id := int64(1); ctx.Err() == nil; id++ {
+				hub.deliver(Event{ID: id, Type: EventTypeMessageCreated, Recipients: []int64{random.Int63n(users), random.Int63n(users)}})
+			}
+		}(int64(i))
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+
+	if err := hub.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	wg.Wait()
+
+	if hub.register(hub.newClient(User{ID: 1}, nil)) {
+		t.Error("client registered after shutdown")
+	}
+
+	for i := range hub.shards {
+		if n := len(hub.shards[i].clients); n != 0 {
+			t.Errorf("shard %d has %d users after shutdown", i, n)
+		}
+	}
+}
+
+func TestHubShutdownTimeout(t *testing.T) {
+	hub := newTestHub(t, 1, OverflowDropOldest)
+
+	// client whose writer does not stop
+	if !hub.register(hub.newClient(User{ID: 1}, nil)) {
+		t.Fatal("client refused")
+	}
+	defer hub.writers.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := hub.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// reconnects with the access token of a device revoked since, whether the client gives the id of the device or not
+func TestServeWebSocketsRevokedDevice(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	hub, err := NewHub(nil, nil, NewDevicesRepositoryPostgreSQL(db), 16, OverflowDropOldest, 1, 100, time.Hour, WebSocketRateLimits{}, WebSocketTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auther := NewAuther("secret", "mig")
+	c := &APIController{auther: auther, hub: hub}
+
+	server := httptest.NewServer(withAuth(c, withUserError(hub.ServeWebSockets)))
+	defer server.Close()
+
+	token, err := auther.New(JWTUser{id: 1, username: "alice", workflowState: "active"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := auther.Parse(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const deviceID = "0f8fad5b-d9cb-469f-a165-70867728950e"
+	revoked := time.Now()
+
+	for _, query := range []string{"", "&device=" + deviceID} {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT (.+) FROM devices WHERE id = \(SELECT device_id FROM device_tokens WHERE token_id = \$1\)`).
+			WithArgs(claims.RegisteredClaims.ID).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "platform", "name", "created_at", "last_active_at", "revoked_at"}).
+				AddRow(deviceID, 1, "web", "", revoked, revoked, revoked))
+		mock.ExpectRollback()
+
+		header := http.Header{"Authorization": []string{"Bearer " + token}}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?platform=web"+query, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = conn.ReadMessage()
+		conn.Close()
+
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != errDeviceRevoked.Error() {
+			t.Errorf("got error %v, want close %d %q", err, websocket.ClosePolicyViolation, errDeviceRevoked.Error())
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeWebSocketsUnauthorized(t *testing.T) {
+	hub := newTestHub(t, 16, OverflowDropOldest)
+	c := &APIController{auther: NewAuther("secret", "mig"), hub: hub}
+
+	server := httptest.NewServer(withAuth(c, withUserError(hub.ServeWebSockets)))
+	defer server.Close()
+
+	other := NewAuther("other", "mig")
+	forged, err := other.New(JWTUser{id: 1, username: "alice", workflowState: "active"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{"", "?access_token=invalid", "?access_token=" + forged} {
+		_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+query, nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("query %q: got response %v, want %d", query, resp, http.StatusUnauthorized)
+		}
+	}
+}
+
+// delivers events to users of a hub with 100k connected clients, whose queues are full
+func BenchmarkHubDeliver(b *testing.B) {
+	const clients = 100_000
+
+	hub := newTestHub(b, 16, OverflowDropOldest)
+
+	for i := int64(0); i < clients; i++ {
+		if !hub.register(hub.newClient(User{ID: i}, nil)) {
+			b.Fatal("client refused")
+		}
+	}
+
+	event := Event{ID: 1, Type: EventTypeMessageCreated}
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		random := rand.New(rand.NewSource(rand.Int63()))
+
+		for pb.Next() {
+			hub.Deliver(random.Int63n(clients), event)
+		}
+	})
+}